@@ -0,0 +1,389 @@
+package prox5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// proxyInfo is how a Proxy is represented by our admin API.
+type proxyInfo struct {
+	Endpoint       string    `json:"endpoint"`
+	Protocol       string    `json:"protocol"`
+	ProxiedIP      string    `json:"proxied_ip,omitempty"`
+	ExitChanges    int64     `json:"exit_changes"`
+	ExitPeers      []string  `json:"exit_peers,omitempty"`
+	LastValidated  time.Time `json:"last_validated"`
+	TimesValidated int64     `json:"times_validated"`
+	TimesSucceeded int64     `json:"times_succeeded"`
+	TimesBad       int64     `json:"times_bad"`
+	SuccessRate    float64   `json:"success_rate"`
+	LastLatency    string    `json:"last_latency,omitempty"`
+	Throughput     int64     `json:"throughput_bps,omitempty"`
+	Anonymity      string    `json:"anonymity"`
+	Geo            *GeoInfo  `json:"geo,omitempty"`
+	UDP            string    `json:"udp,omitempty"`
+	Profiles       []string  `json:"profiles,omitempty"`
+	Untrusted      bool      `json:"untrusted,omitempty"`
+	Intercepting   bool      `json:"intercepting,omitempty"`
+	Stale          bool      `json:"stale"`
+}
+
+func (p5 *ProxyEngine) proxyInfo(sock *Proxy) proxyInfo {
+	info := proxyInfo{
+		Endpoint:       sock.Endpoint,
+		Protocol:       sock.GetProto().String(),
+		ProxiedIP:      sock.GetExitIP(),
+		ExitChanges:    sock.GetExitChanges(),
+		ExitPeers:      sock.GetExitPeers(),
+		LastValidated:  sock.lastValidated,
+		TimesValidated: atomic.LoadInt64(&sock.timesValidated),
+		TimesSucceeded: atomic.LoadInt64(&sock.timesSucceeded),
+		TimesBad:       atomic.LoadInt64(&sock.timesBad),
+		SuccessRate:    sock.GetSuccessRate(),
+		Throughput:     sock.GetThroughput(),
+		Anonymity:      sock.GetAnonymity().String(),
+		UDP:            udpStrings[atomic.LoadUint32(&sock.udp)],
+		Profiles:       sock.GetProfiles(),
+		Untrusted:      sock.IsUntrusted(),
+		Intercepting:   sock.Intercepting(),
+		Stale:          time.Since(sock.lastValidated) > p5.GetStaleTime(),
+	}
+	if latency := sock.GetLastLatency(); latency > 0 {
+		info.LastLatency = latency.String()
+	}
+	if geo, ok := sock.GetGeo(); ok {
+		info.Geo = &geo
+	}
+	return info
+}
+
+// adminStats is how our Statistics are represented by our admin API.
+type adminStats struct {
+	Valid4    int64  `json:"valid4"`
+	Valid4a   int64  `json:"valid4a"`
+	Valid5    int64  `json:"valid5"`
+	ValidHTTP int64  `json:"valid_http"`
+	Dispensed int64  `json:"dispensed"`
+	Stale     int64  `json:"stale"`
+	Checked   int64  `json:"checked"`
+	Bad       int64  `json:"bad"`
+	Known     int    `json:"known"`
+	Pending   int    `json:"pending"`
+	Uptime    string `json:"uptime"`
+	Running   bool   `json:"running"`
+	Workers   struct {
+		Max     int `json:"max"`
+		Running int `json:"running"`
+		Idle    int `json:"idle"`
+	} `json:"workers"`
+	AutoScaler string           `json:"autoscaler"`
+	Endpoints  []EndpointHealth `json:"endpoints"`
+}
+
+// adminOptions are the options that can be read and changed through our admin API.
+// Durations are strings as accepted by time.ParseDuration. Fields left out of a PATCH are left alone.
+type adminOptions struct {
+	ValidationTimeout   *string `json:"validation_timeout,omitempty"`
+	ServerTimeout       *string `json:"server_timeout,omitempty"`
+	StaleTime           *string `json:"stale_time,omitempty"`
+	DialerBailout       *int    `json:"dialer_bailout,omitempty"`
+	RemoveAfter         *int    `json:"remove_after,omitempty"`
+	MaxWorkers          *int    `json:"max_workers,omitempty"`
+	Recycling           *bool   `json:"recycling,omitempty"`
+	AutoScaler          *bool   `json:"autoscaler,omitempty"`
+	AutoScalerMaxScale  *int    `json:"autoscaler_max_scale,omitempty"`
+	AutoScalerThreshold *int    `json:"autoscaler_threshold,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethods writes a 405 and returns false if r was not made with one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// AdminHandler returns an http.Handler exposing a JSON API for managing the ProxyEngine while it runs:
+//
+//   - GET    /proxies             list proxies, filtered by the optional protocol, anonymity (minimum), and stale query parameters
+//   - POST   /proxies             load proxies, one per line in any of the formats accepted by LoadMultiLineString
+//   - DELETE /proxies?endpoint=   remove a proxy, see RemoveProxy
+//   - POST   /proxies/revalidate  validate all proxies (or the one given with ?endpoint=) right away, ratelimits aside,
+//     reporting how many were scheduled and how many were skipped for being leased or already under validation
+//   - GET    /stats               read our Statistics
+//   - GET    /options             read our options
+//   - PATCH  /options             change our options, only the fields given are changed
+//   - POST   /pause, /resume, /close
+//
+// The handler has no authentication of its own, wrap it with your own middleware before exposing it.
+// To mount it under a prefix, use http.StripPrefix.
+func (p5 *ProxyEngine) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxies", p5.adminProxies)
+	mux.HandleFunc("/proxies/revalidate", p5.adminRevalidate)
+	mux.HandleFunc("/stats", p5.adminStats)
+	mux.HandleFunc("/options", p5.adminOptions)
+	mux.HandleFunc("/pause", p5.adminLifecycle(p5.Pause))
+	mux.HandleFunc("/resume", p5.adminLifecycle(p5.Resume))
+	mux.HandleFunc("/close", p5.adminLifecycle(func() error {
+		// Close only complains about us not running, which is of no concern here.
+		_ = p5.Close()
+		return nil
+	}))
+	return mux
+}
+
+func (p5 *ProxyEngine) adminProxies(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		p5.adminListProxies(w, r)
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"loaded": p5.LoadMultiLineString(string(body))})
+	case http.MethodDelete:
+		endpoint := r.URL.Query().Get("endpoint")
+		if endpoint == "" {
+			writeError(w, http.StatusBadRequest, errors.New("missing endpoint"))
+			return
+		}
+		if !p5.RemoveProxy(endpoint) {
+			writeError(w, http.StatusNotFound, errors.New("proxy not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"removed": endpoint})
+	}
+}
+
+func (p5 *ProxyEngine) adminListProxies(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var filters []ProxyFilter
+	if proto := query.Get("protocol"); proto != "" {
+		want := protoFromString(strings.ToLower(proto))
+		if want == ProtoNull && proto != ProtoNull.String() {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown protocol: %s", proto))
+			return
+		}
+		filters = append(filters, func(sock *Proxy) bool { return sock.GetProto() == want })
+	}
+	if level := query.Get("anonymity"); level != "" {
+		min, ok := anonymityFromString(level)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown anonymity level: %s", level))
+			return
+		}
+		filters = append(filters, MinAnonymity(min))
+	}
+	if country := query.Get("country"); country != "" {
+		filters = append(filters, InCountries(strings.Split(country, ",")...))
+	}
+	if s := query.Get("stale"); s != "" {
+		stale, err := strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		staleTime := p5.GetStaleTime()
+		filters = append(filters, func(sock *Proxy) bool { return (time.Since(sock.lastValidated) > staleTime) == stale })
+	}
+	filter := allFilters(filters...)
+
+	proxies := make([]proxyInfo, 0)
+	for tuple := range p5.proxyMap.plot.IterBuffered() {
+		if filter == nil || filter(tuple.Val) {
+			proxies = append(proxies, p5.proxyInfo(tuple.Val))
+		}
+	}
+	writeJSON(w, http.StatusOK, proxies)
+}
+
+func (p5 *ProxyEngine) adminRevalidate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var socks []*Proxy
+	if endpoint := r.URL.Query().Get("endpoint"); endpoint != "" {
+		filtered, _, ok := filterURI(endpoint)
+		sock, found := p5.proxyMap.plot.Get(filtered)
+		if !ok || !found {
+			writeError(w, http.StatusNotFound, errors.New("proxy not found"))
+			return
+		}
+		socks = append(socks, sock)
+	} else {
+		for tuple := range p5.proxyMap.plot.IterBuffered() {
+			socks = append(socks, tuple.Val)
+		}
+	}
+	if p5.pool.IsClosed() {
+		writeError(w, http.StatusServiceUnavailable, errors.New("validation is paused"))
+		return
+	}
+	// proxies that are leased or already being validated are skipped, as are any left over should our pool close.
+	scheduled := 0
+	for _, sock := range socks {
+		if sock.revalidate(p5.pool.Submit) {
+			scheduled++
+		}
+	}
+	writeJSON(w, http.StatusAccepted, map[string]int{"scheduled": scheduled, "skipped": len(socks) - scheduled})
+}
+
+func (p5 *ProxyEngine) adminStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	stats := p5.GetStatistics()
+	out := adminStats{
+		Valid4:     stats.Valid4.Load(),
+		Valid4a:    stats.Valid4a.Load(),
+		Valid5:     stats.Valid5.Load(),
+		ValidHTTP:  stats.ValidHTTP.Load(),
+		Dispensed:  stats.Dispensed.Load(),
+		Stale:      stats.Stale.Load(),
+		Checked:    stats.Checked.Load(),
+		Bad:        p5.GetTotalBad(),
+		Known:      p5.proxyMap.plot.Count(),
+		Uptime:     stats.GetUptime().Round(time.Second).String(),
+		Running:    p5.IsRunning(),
+		AutoScaler: p5.GetAutoScalerStateString(),
+		Endpoints:  p5.GetEndpointHealth(),
+	}
+	p5.Pending.RLock()
+	out.Pending = p5.Pending.Len()
+	p5.Pending.RUnlock()
+	out.Workers.Max, out.Workers.Running, out.Workers.Idle = p5.GetWorkers()
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (p5 *ProxyEngine) currentOptions() adminOptions {
+	durStr := func(d time.Duration) *string {
+		s := d.String()
+		return &s
+	}
+	bailout, removeAfter, maxWorkers := p5.GetDialerBailout(), p5.GetRemoveAfter(), p5.GetMaxWorkers()
+	recycling, scaling := p5.GetRecyclingStatus(), p5.GetAutoScalerStatus()
+	maxScale, threshold := int(atomic.LoadInt64(p5.scaler.Max)), int(atomic.LoadInt64(p5.scaler.Threshold))
+	return adminOptions{
+		ValidationTimeout:   durStr(p5.GetValidationTimeout()),
+		ServerTimeout:       durStr(p5.GetServerTimeout()),
+		StaleTime:           durStr(p5.GetStaleTime()),
+		DialerBailout:       &bailout,
+		RemoveAfter:         &removeAfter,
+		MaxWorkers:          &maxWorkers,
+		Recycling:           &recycling,
+		AutoScaler:          &scaling,
+		AutoScalerMaxScale:  &maxScale,
+		AutoScalerThreshold: &threshold,
+	}
+}
+
+func (p5 *ProxyEngine) adminOptions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, p5.currentOptions())
+		return
+	}
+
+	var opts adminOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// parse everything up front so that a bad request changes nothing
+	durations := make(map[*string]time.Duration)
+	for _, s := range []*string{opts.ValidationTimeout, opts.ServerTimeout, opts.StaleTime} {
+		if s == nil {
+			continue
+		}
+		d, err := time.ParseDuration(*s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		durations[s] = d
+	}
+
+	if opts.ValidationTimeout != nil {
+		p5.SetValidationTimeout(durations[opts.ValidationTimeout])
+	}
+	if opts.ServerTimeout != nil {
+		p5.SetServerTimeout(durations[opts.ServerTimeout])
+	}
+	if opts.StaleTime != nil {
+		p5.SetStaleTime(durations[opts.StaleTime])
+	}
+	if opts.DialerBailout != nil {
+		p5.SetDialerBailout(*opts.DialerBailout)
+	}
+	if opts.RemoveAfter != nil {
+		p5.SetRemoveAfter(*opts.RemoveAfter)
+	}
+	if opts.MaxWorkers != nil {
+		p5.SetMaxWorkers(*opts.MaxWorkers)
+	}
+	if opts.Recycling != nil {
+		if *opts.Recycling {
+			p5.EnableRecycling()
+		} else {
+			p5.DisableRecycling()
+		}
+	}
+	if opts.AutoScaler != nil {
+		if *opts.AutoScaler {
+			p5.EnableAutoScaler()
+		} else {
+			p5.DisableAutoScaler()
+		}
+	}
+	if opts.AutoScalerMaxScale != nil {
+		p5.SetAutoScalerMaxScale(*opts.AutoScalerMaxScale)
+	}
+	if opts.AutoScalerThreshold != nil {
+		p5.SetAutoScalerThreshold(*opts.AutoScalerThreshold)
+	}
+	writeJSON(w, http.StatusOK, p5.currentOptions())
+}
+
+func (p5 *ProxyEngine) adminLifecycle(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		if err := action(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"running": p5.IsRunning()})
+	}
+}
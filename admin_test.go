@@ -0,0 +1,151 @@
+package prox5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	srv := httptest.NewServer(p5.AdminHandler())
+	defer srv.Close()
+
+	do := func(method, path, body string, want int, out any) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, want, resp.StatusCode)
+		}
+		if out != nil {
+			if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var loaded map[string]int
+	do("POST", "/proxies", "127.0.0.1:1080\nsocks4://127.0.0.2:1080\nnonsense\n", http.StatusOK, &loaded)
+	if loaded["loaded"] != 2 {
+		t.Errorf("expected 2 proxies loaded, got %d", loaded["loaded"])
+	}
+	addValidatedProxy(t, p5, "127.0.0.3:1080", ProtoSOCKS5)
+
+	var proxies []proxyInfo
+	do("GET", "/proxies?protocol=socks5", "", http.StatusOK, &proxies)
+	if len(proxies) != 1 || proxies[0].Endpoint != "127.0.0.3:1080" || proxies[0].TimesValidated != 1 {
+		t.Errorf("unexpected filtered proxy list: %+v", proxies)
+	}
+	do("GET", "/proxies", "", http.StatusOK, &proxies)
+	if len(proxies) != 3 {
+		t.Errorf("expected 3 proxies, got %d", len(proxies))
+	}
+	do("GET", "/proxies?protocol=gopher", "", http.StatusBadRequest, nil)
+
+	do("DELETE", "/proxies?endpoint=127.0.0.3:1080", "", http.StatusOK, nil)
+	do("DELETE", "/proxies?endpoint=127.0.0.3:1080", "", http.StatusNotFound, nil)
+	if p5.Valids.SOCKS5.Len() != 0 {
+		t.Error("expected removed proxy to be gone from our valid lists")
+	}
+
+	var opts adminOptions
+	do("PATCH", "/options", `{"stale_time": "5m", "dialer_bailout": 3}`, http.StatusOK, &opts)
+	if p5.GetStaleTime() != 5*time.Minute || p5.GetDialerBailout() != 3 || *opts.StaleTime != "5m0s" {
+		t.Error("options were not changed")
+	}
+	do("PATCH", "/options", `{"stale_time": "5m", "server_timeout": "soon"}`, http.StatusBadRequest, nil)
+	do("PUT", "/options", `{}`, http.StatusMethodNotAllowed, nil)
+
+	var stats adminStats
+	do("GET", "/stats", "", http.StatusOK, &stats)
+	if stats.Valid5 != 1 || stats.Known != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	do("POST", "/pause", "", http.StatusConflict, nil)
+	do("POST", "/resume", "", http.StatusOK, nil)
+	if !p5.IsRunning() {
+		t.Error("expected engine to be running after resume")
+	}
+	do("POST", "/pause", "", http.StatusOK, nil)
+}
+
+func TestAdminRevalidate(t *testing.T) {
+	site := newValidatorSite(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetValidationTimeout(2 * time.Second)
+	p5.SetCheckEndpoints([]string{site.URL + "/ip"})
+	p5.DisableRecycling()
+	srv := httptest.NewServer(p5.AdminHandler())
+	defer srv.Close()
+
+	revalidate := func(want int) map[string]int {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/proxies/revalidate", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode != want {
+			t.Fatalf("expected status %d, got %d", want, resp.StatusCode)
+		}
+		var out map[string]int
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return out
+	}
+
+	sock := addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	leased := addValidatedProxy(t, p5, "127.0.0.1:1", ProtoSOCKS5)
+	lease, err := p5.TryAcquire(func(p *Proxy) bool { return p == leased })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = lease.Release(Outcome{Result: LeaseTargetRefused})
+	}()
+	for i := 0; i < 100; i++ {
+		p5.badProx.Check(sock)
+	}
+	before := p5.GetStatistics().ValidHTTP.Load()
+
+	if out := revalidate(http.StatusAccepted); out["scheduled"] != 1 || out["skipped"] != 1 {
+		t.Fatalf("expected our leased proxy to be skipped, got %v", out)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&sock.timesValidated) < 2 || atomic.LoadUint32(&sock.lock) != stateUnlocked {
+		if time.Now().After(deadline) {
+			t.Fatal("expected our ratelimited proxy to be revalidated anyway")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p5.Valids.HTTP.Len() != 1 || p5.GetStatistics().ValidHTTP.Load() != before {
+		t.Errorf("expected a listed proxy not to be listed again, got %d listed", p5.Valids.HTTP.Len())
+	}
+
+	p5.pool.Release()
+	revalidate(http.StatusServiceUnavailable)
+}
@@ -0,0 +1,188 @@
+package prox5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// AnonymityLevel describes how much a proxy reveals about us to the servers we reach through it.
+// Levels are ordered, a higher level is more anonymous.
+type AnonymityLevel uint8
+
+const (
+	// AnonymityUnknown means the proxy has not been judged, either because no judge endpoint is set or judging failed.
+	AnonymityUnknown AnonymityLevel = iota
+	// AnonymityTransparent proxies pass our real IP address along to the destination.
+	AnonymityTransparent
+	// AnonymityAnonymous proxies hide our real IP address, but reveal that the request came through a proxy.
+	AnonymityAnonymous
+	// AnonymityElite proxies hide our real IP address and do not reveal that they are a proxy.
+	AnonymityElite
+)
+
+var anonymityStrings = map[AnonymityLevel]string{
+	AnonymityUnknown:     "unknown",
+	AnonymityTransparent: "transparent",
+	AnonymityAnonymous:   "anonymous",
+	AnonymityElite:       "elite",
+}
+
+func (a AnonymityLevel) String() string {
+	if s, ok := anonymityStrings[a]; ok {
+		return s
+	}
+	return "invalid"
+}
+
+func anonymityFromString(s string) (AnonymityLevel, bool) {
+	for level, name := range anonymityStrings {
+		if strings.EqualFold(name, s) {
+			return level, true
+		}
+	}
+	return AnonymityUnknown, false
+}
+
+// proxyHeaders are headers that proxies add to the requests they forward, revealing that they are a proxy.
+var proxyHeaders = map[string]struct{}{
+	"VIA":               {},
+	"FORWARDED":         {},
+	"FORWARDED-FOR":     {},
+	"X-FORWARDED":       {},
+	"X-FORWARDED-FOR":   {},
+	"X-FORWARDED-HOST":  {},
+	"X-FORWARDED-PROTO": {},
+	"X-REAL-IP":         {},
+	"CLIENT-IP":         {},
+	"X-CLIENT-IP":       {},
+	"X-ORIGINATING-IP":  {},
+	"X-PROXY-ID":        {},
+	"PROXY-CONNECTION":  {},
+	"X-BLUECOAT-VIA":    {},
+}
+
+// GetAnonymity retrieves the AnonymityLevel the Proxy was last judged to have, see ProxyEngine.SetJudgeEndpoint.
+func (sock *Proxy) GetAnonymity() AnonymityLevel {
+	return AnonymityLevel(atomic.LoadUint32(&sock.anonymity))
+}
+
+// headerName normalizes the name of a header echoed back by a judge, e.g. `"HTTP_X_FORWARDED_FOR"` becomes X-FORWARDED-FOR.
+func headerName(line string) string {
+	i := strings.IndexAny(line, ":=")
+	if i < 1 {
+		return ""
+	}
+	name := strings.Trim(line[:i], " \t\"'")
+	name = strings.ReplaceAll(strings.ToUpper(name), "_", "-")
+	return strings.TrimPrefix(name, "HTTP-")
+}
+
+// containsIP reports whether ip appears anywhere in body as a whole address.
+func containsIP(body, ip string) bool {
+	want := net.ParseIP(ip)
+	if want == nil {
+		return false
+	}
+	v4 := want.To4() != nil
+	tokens := strings.FieldsFunc(body, func(r rune) bool {
+		switch {
+		case r >= '0' && r <= '9', r == '.':
+			return false
+		case !v4 && (r == ':' || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')):
+			return false
+		default:
+			return true
+		}
+	})
+	for _, token := range tokens {
+		if got := net.ParseIP(token); got != nil && got.Equal(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyAnonymity judges a proxy from the headers a judge endpoint echoed back to us.
+// realIP is our own WAN IP, if it is empty we are unable to tell transparent proxies apart from anonymous ones.
+func classifyAnonymity(body, realIP string) AnonymityLevel {
+	if realIP != "" && containsIP(body, realIP) {
+		return AnonymityTransparent
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if _, ok := proxyHeaders[headerName(strings.TrimSpace(line))]; ok {
+			return AnonymityAnonymous
+		}
+	}
+	return AnonymityElite
+}
+
+// getRealIP returns the WAN IP of our own connection as last detected, see detectRealIP.
+// Returns an empty string if our IP has not been determined, it never asks anyone itself.
+func (p5 *ProxyEngine) getRealIP() string {
+	return p5.realIP.Load().(string)
+}
+
+// lookupRealIP asks one of our check endpoints directly for the WAN IP of our own connection.
+func (p5 *ProxyEngine) lookupRealIP() (string, error) {
+	client := &http.Client{Timeout: p5.GetValidationTimeout()}
+	resp, err := client.Get(p5.GetRandomEndpoint())
+	if err != nil {
+		return "", err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	_ = resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("bad response from check endpoint: %q", ip)
+	}
+	return ip, nil
+}
+
+// judgeAnonymity requests our judge endpoint through a freshly validated proxy and stores the resulting AnonymityLevel.
+// Judging is best effort, failures leave the proxy's level as it was and do not count against the proxy.
+func (p5 *ProxyEngine) judgeAnonymity(sock *Proxy, protocol ProxyProtocol, judge string) {
+	realIP := p5.getRealIP()
+
+	_, endpoint := splitEndpoint(sock.Endpoint)
+	conn, err := net.DialTimeout("tcp", endpoint, p5.GetValidationTimeout())
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(p5.GetValidationTimeout()))
+
+	hmd := &handMeDown{
+		sock: sock, conn: conn, under: proxy.Direct, protoCheck: protocol, endpoint: judge, forward: true,
+		tlsCheck: newTLSCheck(),
+	}
+	body, err := p5.validate(hmd)
+	if err != nil {
+		return
+	}
+
+	level := classifyAnonymity(body, realIP)
+	atomic.StoreUint32(&sock.anonymity, uint32(level))
+
+	buf := strs.Get()
+	buf.MustWriteString("judged ")
+	if p5.GetDebugRedactStatus() {
+		buf.MustWriteString("(redacted)")
+	} else {
+		buf.MustWriteString(sock.Endpoint)
+	}
+	buf.MustWriteString(" as ")
+	buf.MustWriteString(level.String())
+	p5.dbgPrint(buf)
+}
@@ -0,0 +1,119 @@
+package prox5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_classifyAnonymity(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want AnonymityLevel
+	}{
+		{"elite", "User-Agent: test\nAccept: */*\n", AnonymityElite},
+		{"via", "User-Agent: test\nVia: 1.1 squid\n", AnonymityAnonymous},
+		{"cgi style", "HTTP_USER_AGENT=test\nHTTP_X_FORWARDED_FOR=10.0.0.1\n", AnonymityAnonymous},
+		{"json", "{\n  \"X-Real-Ip\": \"10.0.0.1\"\n}", AnonymityAnonymous},
+		{"leaked", "User-Agent: test\nX-Forwarded-For: 10.0.0.1, 192.0.2.7\n", AnonymityTransparent},
+		{"leaked without header", "REMOTE_ADDR=192.0.2.7\n", AnonymityTransparent},
+		{"partial address", "X-Client: 192.0.2.70\n", AnonymityElite},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyAnonymity(c.body, "192.0.2.7"); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+	if got := classifyAnonymity("X-Forwarded-For: 192.0.2.7\n", ""); got != AnonymityAnonymous {
+		t.Errorf("without our real IP a leaking proxy should still be caught as a proxy, got %s", got)
+	}
+}
+
+// newHeaderEchoServer stands in for a proxy judge, answering every request with its headers.
+func newHeaderEchoServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.Header.Write(w)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestJudgeAnonymity(t *testing.T) {
+	echo := newIPEchoServer(t)
+	judge := newHeaderEchoServer(t)
+
+	transparent := newDummyHTTPProxy(t, "", "")
+	transparent.inject = http.Header{"X-Forwarded-For": {"127.0.0.1"}}
+	anonymous := newDummyHTTPProxy(t, "", "")
+	anonymous.inject = http.Header{"Via": {"1.1 dummy"}}
+	elite := newDummyHTTPProxy(t, "", "")
+	elite.inject = http.Header{}
+
+	p5 := NewProxyEngine()
+	p5.SetAndEnableDebugLogger(p5TestLogger{t: t})
+	p5.SetCheckEndpoints([]string{echo})
+	p5.SetJudgeEndpoint(judge)
+	p5.SetValidationTimeout(2 * time.Second)
+
+	want := map[string]AnonymityLevel{
+		transparent.Addr().String(): AnonymityTransparent,
+		anonymous.Addr().String():   AnonymityAnonymous,
+		elite.Addr().String():       AnonymityElite,
+	}
+	for endpoint := range want {
+		if !p5.LoadSingleProxy("http://" + endpoint) {
+			t.Fatal("failed to load proxy")
+		}
+	}
+	if err := p5.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = p5.Close()
+	})
+
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		judged := 0
+		for endpoint := range want {
+			if sock, ok := p5.proxyMap.plot.Get(endpoint); ok && sock.GetAnonymity() != AnonymityUnknown {
+				judged++
+			}
+		}
+		if judged == len(want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("proxies were never judged")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for endpoint, level := range want {
+		sock, _ := p5.proxyMap.plot.Get(endpoint)
+		if got := sock.GetAnonymity(); got != level {
+			t.Errorf("%s: got %s, want %s", endpoint, got, level)
+		}
+	}
+
+	if err := p5.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	p5.SetMinAnonymity(AnonymityElite)
+	for i := 0; i < 3; i++ {
+		sock, err := p5.TryGetAnyProxy()
+		if err != nil {
+			break
+		}
+		if sock.Endpoint != elite.Addr().String() {
+			t.Errorf("dispensed %s proxy despite minimum anonymity", sock.GetAnonymity())
+		}
+		p5.enqueue(sock)
+	}
+}
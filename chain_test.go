@@ -0,0 +1,172 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newDeadAddr returns an address nothing listens on.
+func newDeadAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	_ = ln.Close()
+	return dead
+}
+
+func TestDialChain(t *testing.T) {
+	target := strings.TrimPrefix(newIPEchoServer(t), "http://")
+	first, second, third := newDummyHTTPProxy(t, "", ""), newDummyHTTPProxy(t, "", ""), newDummyHTTPProxy(t, "", "")
+	guarded := newDummyHTTPProxy(t, "user", "pass")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+
+	hop := func(dp *dummyHTTPProxy) *Proxy {
+		sock, err := p5.parseChainHop("http://" + dp.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sock
+	}
+
+	conn, err := p5.dialChain([]*Proxy{hop(first), hop(second), hop(third)}, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	for i, dp := range []*dummyHTTPProxy{first, second, third} {
+		if dp.tunnels.Load() != 1 {
+			t.Errorf("expected hop %d to tunnel once, got %d", i, dp.tunnels.Load())
+		}
+	}
+
+	_, err = p5.dialChain([]*Proxy{hop(first), hop(guarded), hop(third)}, "tcp", target)
+	var hopErr *HopError
+	if !errors.As(err, &hopErr) {
+		t.Fatalf("expected a HopError, got %v", err)
+	}
+	if hopErr.Hop != 1 || hopErr.Target {
+		t.Fatalf("expected the second hop to be blamed, got hop %d (target: %t)", hopErr.Hop, hopErr.Target)
+	}
+
+	dead := newDeadAddr(t)
+	_, err = p5.dialChain([]*Proxy{hop(first), {Endpoint: dead, protocol: newImmutableProto(), parent: p5}}, "tcp", target)
+	if !errors.As(err, &hopErr) {
+		t.Fatalf("expected a HopError, got %v", err)
+	}
+	if hopErr.Hop != 0 || !hopErr.Relay || hopErr.Target {
+		t.Fatalf("expected the first hop to be unable to relay us, got hop %d (relay: %t)", hopErr.Hop, hopErr.Relay)
+	}
+
+	if _, err = p5.parseChainHop("127.0.0.1:8080"); err == nil {
+		t.Fatal("expected chain hops without a scheme to be rejected")
+	}
+}
+
+func TestChainDialer(t *testing.T) {
+	target := strings.TrimPrefix(newIPEchoServer(t), "http://")
+	egress := newDummyHTTPProxy(t, "", "")
+	a, b := newDummyHTTPProxy(t, "", ""), newDummyHTTPProxy(t, "", "")
+
+	// the first hop of a circuit through here fails to connect.
+	dead := newDeadAddr(t)
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetAndEnableDebugLogger(p5TestLogger{t: t})
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	p5.SetChainLength(2)
+	broken := addValidatedProxy(t, p5, dead, ProtoHTTP)
+	good := []*Proxy{
+		addValidatedProxy(t, p5, a.Addr().String(), ProtoHTTP),
+		addValidatedProxy(t, p5, b.Addr().String(), ProtoHTTP),
+	}
+	p5.anothaOne()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := p5.DialContext(ctx, "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	if atomic.LoadInt64(&broken.timesBad) == 0 {
+		t.Error("expected the broken hop to be penalized")
+	}
+	for _, sock := range good {
+		if atomic.LoadInt64(&sock.timesBad) != 0 {
+			t.Errorf("healthy hop %s should not be penalized", sock.Endpoint)
+		}
+	}
+	if a.tunnels.Load() == 0 || b.tunnels.Load() == 0 {
+		t.Fatalf("expected both healthy proxies to be part of the circuit, got %d and %d",
+			a.tunnels.Load(), b.tunnels.Load())
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		if err := p5.SetChainPrefix("http://" + egress.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		if prefix := p5.GetChainPrefix(); len(prefix) != 1 || prefix[0] != "http://"+egress.Addr().String() {
+			t.Fatalf("unexpected chain prefix: %v", prefix)
+		}
+		p5.SetChainLength(1)
+		for _, sock := range good {
+			p5.enqueue(sock)
+		}
+		conn, err := p5.DialContext(ctx, "tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		if egress.tunnels.Load() != 1 {
+			t.Fatalf("expected the dial to go through our fixed hop, got %d tunnels", egress.tunnels.Load())
+		}
+	})
+}
+
+func TestChainDialerDeadSecondHop(t *testing.T) {
+	target := strings.TrimPrefix(newIPEchoServer(t), "http://")
+	relay := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(time.Second)
+	p5.DisableRecycling()
+	p5.SetChainLength(2)
+	first := addValidatedProxy(t, p5, relay.Addr().String(), ProtoHTTP)
+	dead := addValidatedProxy(t, p5, newDeadAddr(t), ProtoHTTP)
+	// our session pins the dead proxy as the last hop, so the circuit is first -> dead.
+	p5.sessions.bind("dead", dead, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := p5.DialContext(WithSession(ctx, "dead"), "tcp", target); err == nil {
+		t.Fatal("expected no circuit through our dead proxy to work")
+	}
+	if atomic.LoadInt64(&first.timesBad) != 0 {
+		t.Error("expected the hop that could not reach the dead one not to be penalized")
+	}
+	if p5.sessions.get("dead") != nil {
+		t.Error("expected our session to let go of its dead exit")
+	}
+}
@@ -3,7 +3,6 @@ package prox5
 import (
 	"errors"
 	"sync/atomic"
-	"time"
 )
 
 // engineState represents the current state of our ProxyEngine.
@@ -25,6 +24,8 @@ func (p5 *ProxyEngine) Start() error {
 		return p5.Resume()
 	}
 	p5.DebugLogger.Printf("starting prox5")
+	// our WAN IP is looked up once here rather than by every check that needs it.
+	go p5.watchRealIP(p5.detectRealIP())
 	p5.startDaemons()
 	return nil
 }
@@ -66,34 +67,17 @@ func (p5 *ProxyEngine) Resume() error {
 	return nil
 }
 
-// CloseAllConns will (maybe) close all connections in progress by the dialers (including the SOCKS server if in use).
+// CloseAllConns closes all connections handed out by our dialers, including those in use by our servers.
 // Note this does not effect the proxy pool, it will continue to operate as normal.
-// this is hacky FIXME
 func (p5 *ProxyEngine) CloseAllConns() {
-	timeout := time.NewTicker(5 * time.Second)
-	defer func() {
-		timeout.Stop()
-		select {
-		case p5.conKiller <- struct{}{}:
-		default:
-		}
-	}()
-	for {
-		select {
-		case p5.conKiller <- struct{}{}:
-			timeout.Reset(1 * time.Second)
-			p5.DebugLogger.Printf("killed a connection")
-		case <-p5.ctx.Done():
-			return
-		case <-timeout.C:
-			return
-		}
-	}
+	p5.DebugLogger.Printf("prox5 killed %d connections", p5.conns.closeAll())
 }
 
 func (p5 *ProxyEngine) Close() error {
 	p5.mu.Lock()
 	defer p5.mu.Unlock()
 	p5.quit()
+	p5.events.closeAll()
+	p5.geo.swap(nil, nil)
 	return p5.Pause()
 }
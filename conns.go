@@ -0,0 +1,136 @@
+package prox5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTracker keeps hold of the connections handed out by our dialers, see CloseAllConns.
+type connTracker struct {
+	conns map[*trackedConn]struct{}
+	mu    *sync.Mutex
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[*trackedConn]struct{}),
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (ct *connTracker) add(tc *trackedConn) {
+	ct.mu.Lock()
+	ct.conns[tc] = struct{}{}
+	ct.mu.Unlock()
+}
+
+func (ct *connTracker) remove(tc *trackedConn) {
+	ct.mu.Lock()
+	delete(ct.conns, tc)
+	ct.mu.Unlock()
+}
+
+func (ct *connTracker) len() int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return len(ct.conns)
+}
+
+// closeAll closes every connection we are tracking and returns how many there were.
+func (ct *connTracker) closeAll() int {
+	ct.mu.Lock()
+	conns := make([]*trackedConn, 0, len(ct.conns))
+	for tc := range ct.conns {
+		conns = append(conns, tc)
+	}
+	ct.mu.Unlock()
+	for _, tc := range conns {
+		_ = tc.Close()
+	}
+	return len(conns)
+}
+
+// trackedConn is a connection handed out by our dialers, it leaves our connTracker once closed.
+// It counts the bytes that go through it, so that the throughput of sock can be measured, see Proxy.GetThroughput.
+type trackedConn struct {
+	net.Conn
+	sock    *Proxy
+	tracker *connTracker
+	done    chan struct{}
+	once    *sync.Once
+
+	bytes *atomic.Int64
+	// first and last are when bytes first and last went through the connection, in unix nanoseconds.
+	first *atomic.Int64
+	last  *atomic.Int64
+}
+
+func (tc *trackedConn) count(n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	tc.first.CompareAndSwap(0, now)
+	tc.last.Store(now)
+	tc.bytes.Add(int64(n))
+}
+
+func (tc *trackedConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	tc.count(n)
+	return n, err
+}
+
+func (tc *trackedConn) Write(b []byte) (int, error) {
+	n, err := tc.Conn.Write(b)
+	tc.count(n)
+	return n, err
+}
+
+func (tc *trackedConn) Close() error {
+	tc.once.Do(func() {
+		tc.tracker.remove(tc)
+		close(tc.done)
+		if tc.sock != nil {
+			tc.sock.recordThroughput(tc.bytes.Load(), time.Duration(tc.last.Load()-tc.first.Load()))
+		}
+	})
+	return tc.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection when it supports it, go-socks5 relies on this when proxying.
+func (tc *trackedConn) CloseWrite() error {
+	if cw, ok := tc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// trackConn registers conn with our connTracker and closes it once ctx is done or prox5 is closed.
+// sock is the proxy conn goes through, its throughput is recorded once conn is closed.
+func (p5 *ProxyEngine) trackConn(ctx context.Context, conn net.Conn, sock *Proxy) net.Conn {
+	tc := &trackedConn{
+		Conn:    conn,
+		sock:    sock,
+		tracker: p5.conns,
+		done:    make(chan struct{}),
+		once:    &sync.Once{},
+		bytes:   &atomic.Int64{},
+		first:   &atomic.Int64{},
+		last:    &atomic.Int64{},
+	}
+	p5.conns.add(tc)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = tc.Close()
+		case <-p5.ctx.Done():
+			_ = tc.Close()
+		case <-tc.done:
+		}
+	}()
+	return tc
+}
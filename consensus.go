@@ -0,0 +1,130 @@
+package prox5
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// ErrUntrusted is returned when a proxy has been caught tampering with our checks, see SetExitConsensus.
+	ErrUntrusted = errors.New("proxy is untrustworthy")
+	// ErrNoConsensus is returned when not enough of our check endpoints agreed on a proxy's exit IP, be it because they
+	// failed to answer or because they were told different public IPs, e.g. by a proxy that rotates its exit.
+	ErrNoConsensus = errors.New("check endpoints did not reach consensus on exit IP")
+)
+
+// publicIP reports whether ip could be the exit IP of a proxy as seen by a check endpoint out on the internet.
+func publicIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && !parsed.IsUnspecified() && !parsed.IsLoopback() && !parsed.IsPrivate() &&
+		!parsed.IsLinkLocalUnicast() && !parsed.IsMulticast()
+}
+
+// exitConsensus asks our check endpoints other than those already asked for the exit IP of sock, until k of them
+// agree with exit, as reported by source. An endpoint disagreeing fails the check, as rotating proxies legitimately
+// exit elsewhere with every connection. sock is only flagged as untrustworthy when clearly tampering with our checks:
+// when an exit IP is our own WAN IP, or one no endpoint on the internet could have seen us coming from.
+// Endpoints that fail to answer are not held against the proxy.
+func (p5 *ProxyEngine) exitConsensus(sock *Proxy, protocol ProxyProtocol, exit, source string, k int, asked ...string) error {
+	if err := p5.plausibleExit(sock, exit, source); err != nil {
+		return err
+	}
+	agreed := 1
+	for agreed < k {
+		endpoint := p5.pickEndpoint(asked...)
+		if endpoint == "" {
+			return fmt.Errorf("%w: %d of %d agreed on %s", ErrNoConsensus, agreed, k, exit)
+		}
+		asked = append(asked, endpoint)
+		hmd, err := p5.ipEcho(sock, protocol, endpoint)
+		if err != nil {
+			if hmd == nil || !hmd.tunneled {
+				return err
+			}
+			continue
+		}
+		p5.endpoints.success(endpoint)
+		if hmd.resp == exit {
+			agreed++
+			continue
+		}
+		if err = p5.plausibleExit(sock, hmd.resp, endpoint); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s says our exit IP is %s, %s says %s",
+			ErrNoConsensus, source, exit, endpoint, hmd.resp)
+	}
+	return nil
+}
+
+// plausibleExit flags sock as untrustworthy if source was told an exit IP that can't be the proxy's.
+func (p5 *ProxyEngine) plausibleExit(sock *Proxy, exit, source string) error {
+	if real := p5.getRealIP(); real != "" && exit == real {
+		return p5.untrusted(sock, fmt.Errorf("%w: %s says our exit IP is %s, our own", ErrUntrusted, source, exit))
+	}
+	if !publicIP(exit) {
+		return p5.untrusted(sock, fmt.Errorf("%w: %s says our exit IP is %s, not a public IP", ErrUntrusted, source, exit))
+	}
+	return nil
+}
+
+func (p5 *ProxyEngine) untrusted(sock *Proxy, err error) error {
+	sock.untrusted.Store(true)
+	buf := strs.Get()
+	buf.MustWriteString("untrustworthy proxy: ")
+	if p5.GetDebugRedactStatus() {
+		buf.MustWriteString("(redacted)")
+	} else {
+		buf.MustWriteString(sock.Endpoint)
+	}
+	p5.dbgPrint(buf)
+	p5.emit(EventUntrusted, sock)
+	return err
+}
+
+// IsUntrusted returns whether the proxy has been caught tampering with our checks, see SetExitConsensus.
+// Untrustworthy proxies fail validation for as long as exit IP consensus is enabled.
+func (sock *Proxy) IsUntrusted() bool {
+	return sock.untrusted.Load()
+}
+
+const (
+	// realIPRefresh is how often we look up our WAN IP again once we know it, in case it changed.
+	realIPRefresh = 30 * time.Minute
+	// realIPRetry is how soon we try again after failing to look up our WAN IP.
+	realIPRetry = time.Minute
+)
+
+// detectRealIP looks up the WAN IP of our own connection, so that we can tell when a proxy exits through it.
+// Should the lookup fail, whatever we knew before is kept. Returns whether the lookup succeeded.
+func (p5 *ProxyEngine) detectRealIP() bool {
+	ip, err := p5.lookupRealIP()
+	if err != nil {
+		p5.DebugLogger.Printf("prox5 failed to detect our WAN IP: %v", err)
+		return false
+	}
+	p5.realIP.Store(ip)
+	p5.DebugLogger.Printf("prox5 detected our WAN IP as %s", ip)
+	return true
+}
+
+// watchRealIP looks up our WAN IP again every so often until the ProxyEngine is closed, sooner if the last lookup
+// failed. known is whether the lookup made by Start succeeded. Nothing else looks it up, see getRealIP.
+func (p5 *ProxyEngine) watchRealIP(known bool) {
+	for {
+		wait := realIPRefresh
+		if !known {
+			wait = realIPRetry
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-p5.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		known = p5.detectRealIP()
+	}
+}
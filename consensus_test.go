@@ -0,0 +1,168 @@
+package prox5
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExitConsensus(t *testing.T) {
+	mux := http.NewServeMux()
+	for path, ip := range map[string]string{
+		"/a": "203.0.113.7", "/b": "203.0.113.7\n", "/liar": "198.51.100.1", "/private": "10.0.0.1",
+	} {
+		ip := ip
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(ip))
+		})
+	}
+	site := httptest.NewServer(mux)
+	defer site.Close()
+
+	tests := []struct {
+		name      string
+		endpoints []string
+		k         int
+		realIP    string
+		wantErr   error
+		untrusted bool
+	}{
+		{name: "agreement", endpoints: []string{"/a", "/b"}, k: 2, realIP: "192.0.2.1"},
+		{name: "disabled", endpoints: []string{"/a", "/liar"}, k: 1, realIP: "192.0.2.1"},
+		{name: "disagreement", endpoints: []string{"/a", "/liar"}, k: 2, realIP: "192.0.2.1", wantErr: ErrNoConsensus},
+		{name: "private IP", endpoints: []string{"/a", "/private"}, k: 2, realIP: "192.0.2.1", wantErr: ErrUntrusted, untrusted: true},
+		{name: "our own IP", endpoints: []string{"/a", "/b"}, k: 2, realIP: "203.0.113.7", wantErr: ErrUntrusted, untrusted: true},
+		{name: "too few endpoints", endpoints: []string{"/a", "/b"}, k: 3, realIP: "192.0.2.1", wantErr: ErrNoConsensus},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newDummyHTTPProxy(t, "", "")
+			p5 := NewProxyEngine()
+			defer func() {
+				_ = p5.Close()
+			}()
+			p5.SetValidationTimeout(2 * time.Second)
+			var endpoints []string
+			for _, path := range tt.endpoints {
+				endpoints = append(endpoints, site.URL+path)
+			}
+			p5.SetCheckEndpoints(endpoints)
+			p5.SetExitConsensus(tt.k)
+			p5.realIP.Store(tt.realIP)
+
+			sock, _ := p5.proxyMap.add(upstream.Addr().String())
+			// the liar may or may not be asked first, check a few times.
+			var err error
+			for i := 0; i < 10 && err == nil; i++ {
+				err = p5.ipEchoCheck(sock, ProtoHTTP)
+			}
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil) != (err == nil) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if sock.IsUntrusted() != tt.untrusted {
+				t.Fatalf("expected IsUntrusted to be %t", tt.untrusted)
+			}
+			if tt.untrusted {
+				tunnels := upstream.tunnels.Load()
+				if err = p5.ipEchoCheck(sock, ProtoHTTP); !errors.Is(err, ErrUntrusted) {
+					t.Fatalf("expected untrustworthy proxies to fail validation, got %v", err)
+				}
+				if upstream.tunnels.Load() != tunnels {
+					t.Error("expected untrustworthy proxies not to be checked again")
+				}
+			}
+		})
+	}
+	t.Run("validators", func(t *testing.T) {
+		upstream := newDummyHTTPProxy(t, "", "")
+		p5 := NewProxyEngine()
+		defer func() {
+			_ = p5.Close()
+		}()
+		p5.SetValidationTimeout(2 * time.Second)
+		p5.SetCheckEndpoints([]string{site.URL + "/liar"})
+		sock, _ := p5.proxyMap.add(upstream.Addr().String())
+		err := p5.exitConsensus(sock, ProtoHTTP, "203.0.113.7", "our validators", 2)
+		want := "our validators says our exit IP is 203.0.113.7, " + site.URL + "/liar says 198.51.100.1"
+		if !errors.Is(err, ErrNoConsensus) || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected the disagreement to name both sides, got %v", err)
+		}
+	})
+}
+
+func TestDetectRealIP(t *testing.T) {
+	var asked atomic.Int64
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if asked.Add(1) == 1 {
+			_, _ = w.Write([]byte("not an IP"))
+			return
+		}
+		_, _ = w.Write([]byte("192.0.2.1"))
+	}))
+	defer site.Close()
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetCheckEndpoints([]string{site.URL})
+
+	if p5.detectRealIP() {
+		t.Fatal("expected a bad answer to fail our lookup")
+	}
+	for i := 0; i < 3; i++ {
+		if ip := p5.getRealIP(); ip != "" {
+			t.Fatalf("expected no WAN IP yet, got %q", ip)
+		}
+	}
+	if asked.Load() != 1 {
+		t.Fatalf("expected getRealIP not to ask again on its own, asked %d times", asked.Load())
+	}
+	if !p5.detectRealIP() || p5.getRealIP() != "192.0.2.1" {
+		t.Fatalf("expected a retry to detect our WAN IP, got %q", p5.getRealIP())
+	}
+}
+
+func TestExitConsensusRotation(t *testing.T) {
+	var exits []string
+	for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+		ip := ip
+		exit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(ip))
+		}))
+		defer exit.Close()
+		exits = append(exits, exit.Listener.Addr().String())
+	}
+	// every tunnel through our proxy comes out of the next exit, whatever we ask it to connect to.
+	var conns atomic.Int64
+	upstream := newDummyHTTPProxy(t, "", "")
+	upstream.route = func(string) string {
+		return exits[(conns.Add(1)-1)%int64(len(exits))]
+	}
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetValidationTimeout(2 * time.Second)
+	p5.SetCheckEndpoints([]string{"http://check-a.invalid/ip", "http://check-b.invalid/ip"})
+	p5.SetExitConsensus(2)
+	p5.realIP.Store("192.0.2.1")
+
+	sock, _ := p5.proxyMap.add(upstream.Addr().String())
+	for i := 0; i < 3; i++ {
+		if err := p5.ipEchoCheck(sock, ProtoHTTP); !errors.Is(err, ErrNoConsensus) {
+			t.Fatalf("expected a rotating proxy to fail consensus, got %v", err)
+		}
+		if sock.IsUntrusted() {
+			t.Fatal("expected a rotating proxy not to be flagged as untrustworthy")
+		}
+	}
+	if upstream.tunnels.Load() != 6 {
+		t.Errorf("expected our rotating proxy to be checked every time, got %d tunnels", upstream.tunnels.Load())
+	}
+}
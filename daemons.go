@@ -29,15 +29,22 @@ func (sm proxyMap) add(sock string) (*Proxy, bool) {
 }
 
 func (sm proxyMap) delete(sock string) error {
-	if _, ok := sm.plot.Get(sock); !ok {
+	p, ok := sm.plot.Get(sock)
+	if !ok {
 		return errors.New("proxy not found")
 	}
 	sm.plot.Remove(sock)
+	if sm.parent != nil {
+		sm.parent.exits.forget(p)
+	}
 	return nil
 }
 
 func (sm proxyMap) clear() {
 	sm.plot.Clear()
+	if sm.parent != nil {
+		sm.parent.exits.clear()
+	}
 }
 
 func (p5 *ProxyEngine) recycling() int {
@@ -122,6 +129,11 @@ func (p5 *ProxyEngine) jobSpawner() {
 			var sock *Proxy
 
 			p5.Pending.Lock()
+			// the list may have been emptied since we checked, see RemoveProxy.
+			if p5.Pending.Len() < 1 {
+				p5.Pending.Unlock()
+				continue
+			}
 			switch p5.GetRecyclingStatus() {
 			case true:
 				el := p5.Pending.Front()
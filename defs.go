@@ -3,6 +3,7 @@ package prox5
 import (
 	"container/list"
 	"context"
+	"crypto/x509"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,6 +28,33 @@ func (pl *proxyList) add(p *Proxy) {
 	pl.PushBack(p)
 }
 
+// popMatching removes and returns the first proxy in the list that satisfies filter.
+// A nil filter matches any proxy.
+func (pl *proxyList) popMatching(filter ProxyFilter) *Proxy {
+	pl.Lock()
+	defer pl.Unlock()
+	for e := pl.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*Proxy)
+		if filter == nil || filter(p) {
+			pl.Remove(e)
+			return p
+		}
+	}
+	return nil
+}
+
+// contains returns whether p is in the list.
+func (pl *proxyList) contains(p *Proxy) bool {
+	pl.RLock()
+	defer pl.RUnlock()
+	for e := pl.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Proxy) == p {
+			return true
+		}
+	}
+	return false
+}
+
 func (pl *proxyList) pop() *Proxy {
 	pl.Lock()
 	if pl.Len() < 1 {
@@ -38,22 +66,71 @@ func (pl *proxyList) pop() *Proxy {
 	return p
 }
 
+// notifier wakes up everyone waiting on it each time broadcast is called.
+type notifier struct {
+	mu *sync.Mutex
+	ch chan struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{mu: &sync.Mutex{}, ch: make(chan struct{})}
+}
+
+// wait returns a channel that will be closed upon the next broadcast.
+func (n *notifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+func (n *notifier) broadcast() {
+	n.mu.Lock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+	n.mu.Unlock()
+}
+
 // ProxyChannels will likely be unexported in the future.
 type ProxyChannels struct {
 	// SOCKS5 is a constant stream of verified SOCKS5 proxies
 	SOCKS5 proxyList
 	// SOCKS4 is a constant stream of verified SOCKS4 proxies
 	SOCKS4 proxyList
-	// SOCKS4a is a constant stream of verified SOCKS5 proxies
+	// SOCKS4a is a constant stream of verified SOCKS4a proxies
 	SOCKS4a proxyList
-	// HTTP is a constant stream of verified SOCKS5 proxies
+	// HTTP is a constant stream of verified HTTP CONNECT proxies
 	HTTP proxyList
 }
 
-// Slice returns a slice of all proxyLists in ProxyChannels, note that HTTP is not included.
+// Slice returns a shuffled slice of all proxyLists in ProxyChannels, including HTTP.
 func (pc ProxyChannels) Slice() []*proxyList {
+	lists := []*proxyList{&pc.SOCKS5, &pc.SOCKS4, &pc.SOCKS4a, &pc.HTTP}
+	entropy.GetOptimizedRand().Shuffle(len(lists), func(i, j int) {
+		lists[i], lists[j] = lists[j], lists[i]
+	})
+	return lists
+}
+
+// forProto returns the proxyList that holds validated proxies of the given protocol, or nil if there isn't one.
+func (pc *ProxyChannels) forProto(proto ProxyProtocol) *proxyList {
+	switch proto {
+	case ProtoSOCKS4:
+		return &pc.SOCKS4
+	case ProtoSOCKS4a:
+		return &pc.SOCKS4a
+	case ProtoSOCKS5:
+		return &pc.SOCKS5
+	case ProtoHTTP:
+		return &pc.HTTP
+	default:
+		return nil
+	}
+}
+
+// socksSlice is the same as Slice, minus the HTTP list.
+func (pc ProxyChannels) socksSlice() []*proxyList {
 	lists := []*proxyList{&pc.SOCKS5, &pc.SOCKS4, &pc.SOCKS4a}
-	entropy.GetOptimizedRand().Shuffle(3, func(i, j int) {
+	entropy.GetOptimizedRand().Shuffle(len(lists), func(i, j int) {
 		lists[i], lists[j] = lists[j], lists[i]
 	})
 	return lists
@@ -66,17 +143,37 @@ type ProxyEngine struct {
 
 	// stats holds the Statistics for ProxyEngine
 	stats Statistics
+	// metrics holds our Prometheus metrics, see MetricsHandler.
+	metrics *metrics
+	// events fans out our lifecycle events to subscribers, see Subscribe.
+	events *eventBus
+	// exits indexes our proxies by the IP address they exit through, see GetExitGroups.
+	exits *exitIndex
+	// endpoints keeps account of how our check endpoints have been doing, see GetEndpointHealth.
+	endpoints *endpointTracker
+	// geo resolves the exit IPs of our proxies to their location and network, see SetGeoIPDatabase.
+	geo *geoDB
 
 	Status uint32
 
 	// Pending is a constant stream of proxy strings to be verified
 	Pending proxyList
 
+	// tallied is broadcast to every time a proxy is placed into one of our valid lists.
+	tallied *notifier
+
 	// see: https://pkg.go.dev/github.com/yunginnanet/Rate5
 	useProx *rl.Limiter
 	badProx *rl.Limiter
 
 	dispenseMiddleware func(*Proxy) (*Proxy, bool)
+	selector           Selector
+
+	// sessions holds the proxies our sticky sessions are bound to, see WithSession.
+	sessions *sessionTable
+
+	// stopAutosave stops the running autosave routine, if any. See SetAutoSave.
+	stopAutosave context.CancelFunc
 
 	ctx  context.Context
 	quit context.CancelFunc
@@ -88,7 +185,10 @@ type ProxyEngine struct {
 
 	// reaper sync.Pool
 
-	conKiller chan struct{}
+	// conns holds the connections handed out by our dialers, see CloseAllConns.
+	conns *connTracker
+	// users counts the usage of each user of our servers, see SetUserStore.
+	users *userTable
 
 	recycleMu *sync.Mutex
 	mu        *sync.RWMutex
@@ -101,6 +201,9 @@ type ProxyEngine struct {
 
 	lastBadProxAnnnounced *atomic.Value
 
+	// realIP caches the WAN IP of our own connection, see getRealIP.
+	realIP *atomic.Value
+
 	opt            *config
 	runningdaemons int32
 	conductor      chan bool
@@ -138,6 +241,9 @@ func defOpt() *config {
 		debug:          true,
 		dialerBailout:  defaultBailout,
 		stale:          defaultStaleTime,
+		sessionTTL:     defaultSessionTTL,
+		chainLength:    1,
+		udpProbeTarget: defaultUDPProbeTarget,
 		maxWorkers:     defaultWorkerCount,
 		redact:         false,
 		tlsVerify:      false,
@@ -160,6 +266,41 @@ type config struct {
 	debug bool
 	// checkEndpoints includes web services that respond with (just) the WAN IP of the connection for validation purposes
 	checkEndpoints []string
+	// judgeEndpoint is a web service that echoes back the headers of our request, used to classify the anonymity of proxies.
+	// when empty, anonymity is not judged.
+	judgeEndpoint string
+	// minAnonymity is the minimum anonymity level a proxy must be judged to have before it will be dispensed.
+	minAnonymity AnonymityLevel
+	// sessionTTL is how long a sticky session holds on to its proxy, see WithSession.
+	sessionTTL time.Duration
+	// serverStickySessions determines whether or not each client of our SOCKS5 server is given its own sticky session.
+	serverStickySessions bool
+	// distinctExits determines whether or not concurrent leases are guaranteed to exit through different IP addresses.
+	distinctExits bool
+	// udpProbe determines whether or not SOCKS5 proxies are checked for UDP support during validation.
+	udpProbe bool
+	// udpProbeTarget is the DNS server our UDP probe queries, see SetUDPProbeTarget.
+	udpProbeTarget string
+	// chainLength is how many proxies from our pool each dial tunnels through, see SetChainLength.
+	chainLength int
+	// chainPrefix are fixed hops that every chained dial goes through before those from our pool, see SetChainPrefix.
+	chainPrefix []*Proxy
+	// dispenseFilter is applied to every proxy we dispense, see SetDispenseFilter.
+	dispenseFilter ProxyFilter
+	// userStore authenticates the users of our servers, see SetUserStore.
+	userStore UserStore
+	// validators replace our default IP echo check when set, see SetValidators.
+	validators []Validator
+	// exitConsensus is how many of our check endpoints must agree on the exit IP of a proxy, see SetExitConsensus.
+	exitConsensus int
+	// profiles are the named validation profiles our proxies are checked against, see AddValidationProfile.
+	profiles map[string]ValidationProfile
+	// usernameParams determines whether or not clients of our servers may pass routing parameters in their username.
+	usernameParams bool
+	// autosavePath is the file our state is periodically saved to, see SetAutoSave.
+	autosavePath string
+	// autosaveInterval is how often our state is saved to autosavePath.
+	autosaveInterval time.Duration
 	// maxWorkers determines the maximum amount of workers used for checking proxies
 	maxWorkers int
 	// validationTimeout defines the timeout for proxy validation operations.
@@ -179,6 +320,12 @@ type config struct {
 	shuffle bool
 	// tlsVerify determines whether or not we verify the TLS certificate of the endpoints the http client connects to.
 	tlsVerify bool
+	// tlsRoots are the root CAs certificates are verified against during validation, the system roots if nil.
+	tlsRoots *x509.CertPool
+	// tlsPins are the fingerprints we expect the certificates of our check endpoints to match, keyed by host.
+	tlsPins map[string][]string
+	// allowIntercepting determines whether or not we dispense proxies caught intercepting TLS, see Intercepting.
+	allowIntercepting bool
 
 	// TODO: make getters and setters for these
 	useProxConfig rl.Policy
@@ -213,12 +360,20 @@ func NewProxyEngine() *ProxyEngine {
 
 		opt:                   defOpt(),
 		lastBadProxAnnnounced: &atomic.Value{},
+		realIP:                &atomic.Value{},
 
 		conductor:     make(chan bool),
 		mu:            &sync.RWMutex{},
 		recycleMu:     &sync.Mutex{},
 		httpOptsDirty: &atomic.Bool{},
-		conKiller:     make(chan struct{}, 1),
+		conns:         newConnTracker(),
+		users:         newUserTable(),
+		tallied:       newNotifier(),
+		sessions:      newSessionTable(),
+		events:        newEventBus(),
+		exits:         newExitIndex(),
+		endpoints:     newEndpointTracker(),
+		geo:           newGeoDB(),
 		Status:        uint32(stateNew),
 	}
 
@@ -227,6 +382,7 @@ func NewProxyEngine() *ProxyEngine {
 	p5.stats.accountingLastDone.Store(&tnow)
 
 	p5.lastBadProxAnnnounced.Store("")
+	p5.realIP.Store("")
 	p5.httpOptsDirty.Store(false)
 	p5.httpClients = &sync.Pool{New: func() interface{} { return p5.newHTTPClient() }}
 
@@ -237,6 +393,7 @@ func NewProxyEngine() *ProxyEngine {
 	for _, i := range stats {
 		*i = &atomic.Int64{}
 	}
+	p5.metrics = newMetrics(p5)
 
 	lists := []*proxyList{&p5.Valids.SOCKS5, &p5.Valids.SOCKS4, &p5.Valids.SOCKS4a, &p5.Valids.HTTP, &p5.Pending}
 	for _, c := range lists {
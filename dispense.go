@@ -1,103 +1,273 @@
 package prox5
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
 	"sync/atomic"
 	"time"
 )
 
-func (p5 *ProxyEngine) getSocksStr(proto ProxyProtocol) string {
-	var sock *Proxy
-	var list *proxyList
-	switch proto {
-	case ProtoSOCKS4:
-		list = &p5.Valids.SOCKS4
-	case ProtoSOCKS4a:
-		list = &p5.Valids.SOCKS4a
-	case ProtoSOCKS5:
-		list = &p5.Valids.SOCKS5
-	case ProtoHTTP:
-		list = &p5.Valids.HTTP
+// ErrEngineClosed is returned by the getters when the ProxyEngine has been closed.
+var ErrEngineClosed = errors.New("prox5 engine closed")
+
+// popFirst removes and returns the first proxy in lists that satisfies filter.
+func popFirst(lists []*proxyList, filter ProxyFilter) *Proxy {
+	for _, list := range lists {
+		if sock := list.popMatching(filter); sock != nil {
+			return sock
+		}
 	}
-	for {
-		if list.Len() == 0 {
-			p5.recycling()
-			time.Sleep(250 * time.Millisecond)
-			continue
+	return nil
+}
+
+// popSelected removes and returns the proxy in lists that sel chooses out of those that satisfy filter.
+func (p5 *ProxyEngine) popSelected(sel Selector, lists []*proxyList, filter ProxyFilter) *Proxy {
+	// always lock in the same order, lists is usually shuffled.
+	// note that Slice hands out copies of our proxyLists, so we compare what they point to.
+	var locked []*proxyList
+	for _, canonical := range []*proxyList{&p5.Valids.SOCKS5, &p5.Valids.SOCKS4, &p5.Valids.SOCKS4a, &p5.Valids.HTTP} {
+		for _, l := range lists {
+			if l.List == canonical.List {
+				locked = append(locked, l)
+				break
+			}
+		}
+	}
+	for _, l := range locked {
+		l.Lock()
+	}
+	defer func() {
+		for _, l := range locked {
+			l.Unlock()
+		}
+	}()
+
+	var (
+		candidates []*Proxy
+		elements   []*list.Element
+		owners     []*proxyList
+		seen       = make(map[*Proxy]struct{})
+	)
+	for _, l := range locked {
+		for e := l.Front(); e != nil; e = e.Next() {
+			sock := e.Value.(*Proxy)
+			if _, dupe := seen[sock]; dupe {
+				continue
+			}
+			if filter != nil && !filter(sock) {
+				continue
+			}
+			seen[sock] = struct{}{}
+			candidates = append(candidates, sock)
+			elements = append(elements, e)
+			owners = append(owners, l)
 		}
-		list.Lock()
-		sock = list.Remove(list.Front()).(*Proxy)
-		list.Unlock()
-		switch {
-		case sock == nil:
-			p5.recycling()
-			time.Sleep(250 * time.Millisecond)
-			continue
-		case !p5.stillGood(sock):
-			continue
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	chosen := sel.Select(candidates)
+	if chosen < 0 || chosen >= len(candidates) {
+		chosen = 0
+	}
+	owners[chosen].Remove(elements[chosen])
+	return candidates[chosen]
+}
+
+// popGood pulls proxies from lists until it finds one that satisfies filter and is still good.
+// If a Selector has been set, it decides which proxy is pulled, otherwise they are pulled in order.
+// Proxies that are no longer good are discarded along the way. Returns nil if no such proxy was found.
+func (p5 *ProxyEngine) popGood(lists []*proxyList, filter ProxyFilter) *Proxy {
+	sel := p5.GetSelector()
+	filter = p5.engineFilter(filter)
+	for {
+		var sock *Proxy
+		switch sel {
+		case nil:
+			sock = popFirst(lists, filter)
 		default:
-			p5.stats.dispense()
-			return sock.Endpoint
+			sock = p5.popSelected(sel, lists, filter)
+		}
+		if sock == nil {
+			return nil
+		}
+		if p5.stillGood(sock) {
+			atomic.StoreInt64(&sock.lastUsed, time.Now().UnixNano())
+			return sock
+		}
+	}
+}
+
+// tryDispense makes a single non-blocking attempt at dispensing a proxy from lists.
+func (p5 *ProxyEngine) tryDispense(lists []*proxyList, filter ProxyFilter) (*Proxy, error) {
+	if p5.ctx.Err() != nil {
+		return nil, ErrEngineClosed
+	}
+	if sock := p5.popGood(lists, filter); sock != nil {
+		p5.stats.dispense()
+		p5.emit(EventDispensed, sock)
+		return sock, nil
+	}
+	p5.recycling()
+	return nil, ErrNoProxies
+}
+
+// waitFor calls try until it returns something other than ErrNoProxies.
+// Between attempts it sleeps until a proxy is tallied, ctx is done, or the ProxyEngine is closed.
+func (p5 *ProxyEngine) waitFor(ctx context.Context, try func() error) error {
+	for {
+		wake := p5.tallied.wait()
+		if err := try(); !errors.Is(err, ErrNoProxies) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("context done: %w", ctx.Err())
+		case <-p5.ctx.Done():
+			return ErrEngineClosed
+		case <-wake:
 		}
 	}
 }
 
+func (p5 *ProxyEngine) dispenseContext(ctx context.Context, lists func() []*proxyList) (sock *Proxy, err error) {
+	err = p5.waitFor(ctx, func() error {
+		var tryErr error
+		sock, tryErr = p5.tryDispense(lists(), FilterFromContext(ctx))
+		return tryErr
+	})
+	return sock, err
+}
+
+func (p5 *ProxyEngine) getSocksStrContext(ctx context.Context, proto ProxyProtocol) (string, error) {
+	sock, err := p5.dispenseContext(ctx, func() []*proxyList {
+		return []*proxyList{p5.Valids.forProto(proto)}
+	})
+	if err != nil {
+		return "", err
+	}
+	return sock.Endpoint, nil
+}
+
+func (p5 *ProxyEngine) trySocksStr(proto ProxyProtocol) (string, error) {
+	sock, err := p5.tryDispense([]*proxyList{p5.Valids.forProto(proto)}, nil)
+	if err != nil {
+		return "", err
+	}
+	return sock.Endpoint, nil
+}
+
+func (p5 *ProxyEngine) getSocksStr(proto ProxyProtocol) string {
+	sock, _ := p5.getSocksStrContext(context.Background(), proto)
+	return sock
+}
+
 // Socks5Str gets a SOCKS5 proxy that we have fully verified (dialed and then retrieved our IP address from a what-is-my-ip endpoint.
 // Will block if one is not available!
 func (p5 *ProxyEngine) Socks5Str() string {
 	return p5.getSocksStr(ProtoSOCKS5)
 }
 
+// Socks5StrContext is the same as Socks5Str, but gives up when ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) Socks5StrContext(ctx context.Context) (string, error) {
+	return p5.getSocksStrContext(ctx, ProtoSOCKS5)
+}
+
+// TrySocks5Str is the same as Socks5Str, but returns ErrNoProxies instead of blocking if one is not available.
+func (p5 *ProxyEngine) TrySocks5Str() (string, error) {
+	return p5.trySocksStr(ProtoSOCKS5)
+}
+
 // Socks4Str gets a SOCKS4 proxy that we have fully verified.
 // Will block if one is not available!
 func (p5 *ProxyEngine) Socks4Str() string {
 	return p5.getSocksStr(ProtoSOCKS4)
 }
 
+// Socks4StrContext is the same as Socks4Str, but gives up when ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) Socks4StrContext(ctx context.Context) (string, error) {
+	return p5.getSocksStrContext(ctx, ProtoSOCKS4)
+}
+
+// TrySocks4Str is the same as Socks4Str, but returns ErrNoProxies instead of blocking if one is not available.
+func (p5 *ProxyEngine) TrySocks4Str() (string, error) {
+	return p5.trySocksStr(ProtoSOCKS4)
+}
+
 // Socks4aStr gets a SOCKS4 proxy that we have fully verified.
 // Will block if one is not available!
 func (p5 *ProxyEngine) Socks4aStr() string {
 	return p5.getSocksStr(ProtoSOCKS4a)
 }
 
+// Socks4aStrContext is the same as Socks4aStr, but gives up when ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) Socks4aStrContext(ctx context.Context) (string, error) {
+	return p5.getSocksStrContext(ctx, ProtoSOCKS4a)
+}
+
+// TrySocks4aStr is the same as Socks4aStr, but returns ErrNoProxies instead of blocking if one is not available.
+func (p5 *ProxyEngine) TrySocks4aStr() (string, error) {
+	return p5.trySocksStr(ProtoSOCKS4a)
+}
+
 // GetHTTPTunnel checks for an available HTTP CONNECT proxy in our pool.
+// Will block if one is not available!
 func (p5 *ProxyEngine) GetHTTPTunnel() string {
 	return p5.getSocksStr(ProtoHTTP)
 }
 
-// GetAnySOCKS retrieves any version SOCKS proxy as a Proxy type
-// Will block if one is not available!
-func (p5 *ProxyEngine) GetAnySOCKS() *Proxy {
-	defer p5.stats.dispense()
+// GetHTTPTunnelContext is the same as GetHTTPTunnel, but gives up when ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) GetHTTPTunnelContext(ctx context.Context) (string, error) {
+	return p5.getSocksStrContext(ctx, ProtoHTTP)
+}
 
-	for {
-		var sock *Proxy
-		select {
-		case <-p5.ctx.Done():
-			return nil
-		default:
-			time.Sleep(2 * time.Millisecond)
-		}
-		for _, list := range p5.Valids.Slice() {
-			list.RLock()
-			if list.Len() < 1 {
-				time.Sleep(15 * time.Millisecond)
-				list.RUnlock()
-				continue
-			}
+// TryGetHTTPTunnel is the same as GetHTTPTunnel, but returns ErrNoProxies instead of blocking if one is not available.
+func (p5 *ProxyEngine) TryGetHTTPTunnel() (string, error) {
+	return p5.trySocksStr(ProtoHTTP)
+}
 
-			list.RUnlock()
-			sock = list.pop()
-			switch {
-			case sock == nil:
-				p5.recycling()
-				time.Sleep(50 * time.Millisecond)
-			case p5.stillGood(sock):
-				return sock
-			default:
-			}
-			continue
-		}
+// GetAnySOCKS retrieves any version SOCKS proxy as a Proxy type.
+// If any validation profiles are named, the proxy must currently pass all of them, see AddValidationProfile.
+// Will block if one is not available! Returns nil if the ProxyEngine is closed.
+func (p5 *ProxyEngine) GetAnySOCKS(profiles ...string) *Proxy {
+	sock, _ := p5.GetAnySOCKSContext(context.Background(), profiles...)
+	return sock
+}
+
+// GetAnySOCKSContext is the same as GetAnySOCKS, but gives up when ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) GetAnySOCKSContext(ctx context.Context, profiles ...string) (*Proxy, error) {
+	if filter := profileFilter(profiles); filter != nil {
+		ctx = WithFilter(ctx, filter)
+	}
+	return p5.dispenseContext(ctx, p5.Valids.socksSlice)
+}
+
+// TryGetAnySOCKS is the same as GetAnySOCKS, but returns ErrNoProxies instead of blocking if one is not available.
+func (p5 *ProxyEngine) TryGetAnySOCKS(profiles ...string) (*Proxy, error) {
+	return p5.tryDispense(p5.Valids.socksSlice(), profileFilter(profiles))
+}
+
+// GetAnyProxy retrieves any validated proxy as a Proxy type, including HTTP CONNECT proxies.
+// If any validation profiles are named, the proxy must currently pass all of them, see AddValidationProfile.
+// Will block if one is not available! Returns nil if the ProxyEngine is closed.
+func (p5 *ProxyEngine) GetAnyProxy(profiles ...string) *Proxy {
+	sock, _ := p5.GetAnyProxyContext(context.Background(), profiles...)
+	return sock
+}
+
+// GetAnyProxyContext is the same as GetAnyProxy, but gives up when ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) GetAnyProxyContext(ctx context.Context, profiles ...string) (*Proxy, error) {
+	if filter := profileFilter(profiles); filter != nil {
+		ctx = WithFilter(ctx, filter)
 	}
+	return p5.dispenseContext(ctx, p5.Valids.Slice)
+}
+
+// TryGetAnyProxy is the same as GetAnyProxy, but returns ErrNoProxies instead of blocking if one is not available.
+func (p5 *ProxyEngine) TryGetAnyProxy(profiles ...string) (*Proxy, error) {
+	return p5.tryDispense(p5.Valids.Slice(), profileFilter(profiles))
 }
 
 func (p5 *ProxyEngine) stillGood(sock *Proxy) bool {
@@ -116,11 +286,14 @@ func (p5 *ProxyEngine) stillGood(sock *Proxy) bool {
 		p5.dbgPrint(buf)
 		if err := p5.proxyMap.delete(sock.Endpoint); err != nil {
 			p5.dbgPrint(simpleString(err.Error()))
+		} else {
+			p5.emit(EventRemoved, sock)
 		}
 		return false
 	}
 
 	if p5.badProx.Peek(sock) {
+		p5.metrics.badRateLimited.Inc()
 		p5.msgBadProxRate(sock)
 		return false
 	}
@@ -131,6 +304,7 @@ func (p5 *ProxyEngine) stillGood(sock *Proxy) bool {
 		buf.MustWriteString(sock.Endpoint)
 		p5.dbgPrint(buf)
 		p5.stats.stale()
+		p5.emit(EventStale, sock)
 		return false
 	}
 
@@ -0,0 +1,94 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTryGetters(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+
+	if _, err := p5.TrySocks5Str(); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected ErrNoProxies from empty pool, got %v", err)
+	}
+	if _, err := p5.TryGetAnySOCKS(); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected ErrNoProxies from empty pool, got %v", err)
+	}
+
+	addValidatedProxy(t, p5, "127.0.0.1:8080", ProtoHTTP)
+
+	if _, err := p5.TryGetAnySOCKS(); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected TryGetAnySOCKS to ignore HTTP proxies, got %v", err)
+	}
+	sock, err := p5.TryGetAnyProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sock.Endpoint != "127.0.0.1:8080" {
+		t.Errorf("unexpected proxy: %s", sock.Endpoint)
+	}
+	if p5.GetStatistics().Dispensed.Load() != 1 {
+		t.Errorf("expected one dispensed proxy, got %d", p5.GetStatistics().Dispensed.Load())
+	}
+}
+
+func TestContextGetters(t *testing.T) {
+	p5 := NewProxyEngine()
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err := p5.Socks5StrContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	})
+
+	t.Run("woken by tally", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		got := make(chan string, 1)
+		go func() {
+			sock, err := p5.Socks4StrContext(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			got <- sock
+		}()
+		time.Sleep(50 * time.Millisecond)
+		addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS4)
+		select {
+		case sock := <-got:
+			if sock != "127.0.0.1:1080" {
+				t.Errorf("unexpected proxy: %s", sock)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("getter was not woken up when a proxy was tallied")
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := p5.GetAnySOCKSContext(context.Background())
+			errs <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		_ = p5.Close()
+		select {
+		case err := <-errs:
+			if !errors.Is(err, ErrEngineClosed) {
+				t.Fatalf("expected ErrEngineClosed, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("getter was not woken up when the engine was closed")
+		}
+		if _, err := p5.TrySocks5Str(); !errors.Is(err, ErrEngineClosed) {
+			t.Fatalf("expected ErrEngineClosed, got %v", err)
+		}
+	})
+}
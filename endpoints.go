@@ -0,0 +1,209 @@
+package prox5
+
+import (
+	"sync"
+	"time"
+
+	"git.tcp.direct/kayos/common/entropy"
+)
+
+const (
+	// endpointMinSamples is how many results we want from a check endpoint before judging it.
+	endpointMinSamples = 10
+	// endpointMaxSamples is how many results we keep before halving them, so old results fade out.
+	endpointMaxSamples = 200
+	// endpointDivergence is how much higher than the others an endpoint's failure rate may be before it is quarantined.
+	endpointDivergence = 0.5
+	// endpointQuarantine is how long a quarantined endpoint is left out of our checks.
+	endpointQuarantine = 10 * time.Minute
+)
+
+// EndpointHealth is how one of our check endpoints has been doing, see GetEndpointHealth.
+type EndpointHealth struct {
+	Endpoint  string `json:"endpoint"`
+	Successes int64  `json:"successes"`
+	// Failures only counts the times the endpoint failed us while another endpoint worked through the same proxy.
+	Failures    int64   `json:"failures"`
+	FailureRate float64 `json:"failure_rate"`
+	Quarantined bool    `json:"quarantined"`
+	// QuarantinedUntil is when the endpoint is put back into rotation, if it is quarantined.
+	QuarantinedUntil time.Time `json:"quarantined_until,omitempty"`
+	// Quarantines is how many times the endpoint has been quarantined.
+	Quarantines int64 `json:"quarantines"`
+}
+
+type endpointStats struct {
+	successes        int64
+	failures         int64
+	quarantines      int64
+	quarantinedUntil time.Time
+}
+
+func (es *endpointStats) failureRate() float64 {
+	if es.successes+es.failures == 0 {
+		return 0
+	}
+	return float64(es.failures) / float64(es.successes+es.failures)
+}
+
+func (es *endpointStats) quarantined(now time.Time) bool {
+	return now.Before(es.quarantinedUntil)
+}
+
+// endpointTracker keeps account of how each of our check endpoints has been doing, so that an endpoint going down
+// does not take every proxy that happens to draw it down with it.
+type endpointTracker struct {
+	stats map[string]*endpointStats
+	mu    *sync.Mutex
+}
+
+func newEndpointTracker() *endpointTracker {
+	return &endpointTracker{
+		stats: make(map[string]*endpointStats),
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (et *endpointTracker) get(endpoint string) *endpointStats {
+	es, ok := et.stats[endpoint]
+	if !ok {
+		es = &endpointStats{}
+		et.stats[endpoint] = es
+	}
+	if es.successes+es.failures >= endpointMaxSamples {
+		es.successes /= 2
+		es.failures /= 2
+	}
+	return es
+}
+
+func (et *endpointTracker) success(endpoint string) {
+	et.mu.Lock()
+	et.get(endpoint).successes++
+	et.mu.Unlock()
+}
+
+// failure counts a failure against endpoint, quarantining it if it has been failing far more often than the rest of
+// our check endpoints. Returns whether endpoint was quarantined. The last endpoint standing is never quarantined.
+func (et *endpointTracker) failure(endpoint string) bool {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	es := et.get(endpoint)
+	es.failures++
+	if es.successes+es.failures < endpointMinSamples {
+		return false
+	}
+	now := time.Now()
+	var others, otherFailures, healthy int64
+	for name, other := range et.stats {
+		if name == endpoint || other.quarantined(now) {
+			continue
+		}
+		healthy++
+		others += other.successes + other.failures
+		otherFailures += other.failures
+	}
+	if healthy == 0 {
+		return false
+	}
+	var othersRate float64
+	if others > 0 {
+		othersRate = float64(otherFailures) / float64(others)
+	}
+	if es.failureRate()-othersRate < endpointDivergence {
+		return false
+	}
+	es.quarantinedUntil = now.Add(endpointQuarantine)
+	es.quarantines++
+	// start over once the quarantine is up.
+	es.successes, es.failures = 0, 0
+	return true
+}
+
+// usable returns those of endpoints that are not quarantined, leaving out exclude.
+func (et *endpointTracker) usable(endpoints []string, exclude ...string) []string {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	now := time.Now()
+	usable := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if excluded(endpoint, exclude) {
+			continue
+		}
+		if es, ok := et.stats[endpoint]; ok && es.quarantined(now) {
+			continue
+		}
+		usable = append(usable, endpoint)
+	}
+	return usable
+}
+
+func (et *endpointTracker) health(endpoints []string) []EndpointHealth {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	now := time.Now()
+	health := make([]EndpointHealth, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		eh := EndpointHealth{Endpoint: endpoint}
+		if es, ok := et.stats[endpoint]; ok {
+			eh.Successes, eh.Failures, eh.Quarantines = es.successes, es.failures, es.quarantines
+			eh.FailureRate = es.failureRate()
+			if es.quarantined(now) {
+				eh.Quarantined, eh.QuarantinedUntil = true, es.quarantinedUntil
+			}
+		}
+		health = append(health, eh)
+	}
+	return health
+}
+
+func excluded(endpoint string, exclude []string) bool {
+	for _, ex := range exclude {
+		if endpoint == ex {
+			return true
+		}
+	}
+	return false
+}
+
+// pickEndpoint returns a random check endpoint that is neither quarantined nor one of exclude.
+// If every other endpoint is quarantined, any of them will do. Returns an empty string if there is none.
+func (p5 *ProxyEngine) pickEndpoint(exclude ...string) string {
+	p5.mu.RLock()
+	endpoints := p5.opt.checkEndpoints
+	p5.mu.RUnlock()
+	usable := p5.endpoints.usable(endpoints, exclude...)
+	if len(usable) == 0 {
+		for _, endpoint := range endpoints {
+			if !excluded(endpoint, exclude) {
+				usable = append(usable, endpoint)
+			}
+		}
+	}
+	if len(usable) == 0 {
+		return ""
+	}
+	return entropy.RandomStrChoice(usable)
+}
+
+// endpointFailed counts a failure against one of our check endpoints.
+func (p5 *ProxyEngine) endpointFailed(endpoint string) {
+	if !p5.endpoints.failure(endpoint) {
+		return
+	}
+	buf := strs.Get()
+	buf.MustWriteString("quarantined check endpoint: ")
+	buf.MustWriteString(endpoint)
+	p5.dbgPrint(buf)
+}
+
+// GetEndpointHealth returns how each of our check endpoints has been doing, see SetCheckEndpoints.
+// When a proxy fails our check, it is given a second chance against another endpoint before it is blamed. If that one
+// works, the failure is counted against the first endpoint instead, and endpoints failing far more often than the rest
+// are quarantined for a while.
+func (p5 *ProxyEngine) GetEndpointHealth() []EndpointHealth {
+	p5.mu.RLock()
+	endpoints := p5.opt.checkEndpoints
+	p5.mu.RUnlock()
+	return p5.endpoints.health(endpoints)
+}
@@ -0,0 +1,77 @@
+package prox5
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEndpointTracker(t *testing.T) {
+	et := newEndpointTracker()
+	endpoints := []string{"https://a.example", "https://b.example"}
+	for i := 0; i < endpointMinSamples; i++ {
+		et.success(endpoints[1])
+	}
+	for i := 0; i < endpointMinSamples-1; i++ {
+		if et.failure(endpoints[0]) {
+			t.Fatalf("expected no quarantine before %d samples", endpointMinSamples)
+		}
+	}
+	if !et.failure(endpoints[0]) {
+		t.Fatal("expected an endpoint failing far more often than the others to be quarantined")
+	}
+	if got := et.usable(endpoints, ""); !reflect.DeepEqual(got, endpoints[1:]) {
+		t.Fatalf("expected only %v to be usable, got %v", endpoints[1:], got)
+	}
+	for i := 0; i < endpointMinSamples; i++ {
+		if et.failure(endpoints[1]) {
+			t.Fatal("expected the last endpoint standing not to be quarantined")
+		}
+	}
+	health := et.health(endpoints)
+	if !health[0].Quarantined || health[0].Quarantines != 1 || time.Until(health[0].QuarantinedUntil) <= 0 {
+		t.Errorf("unexpected health for our quarantined endpoint: %+v", health[0])
+	}
+	if health[1].Quarantined || health[1].Failures != endpointMinSamples || health[1].FailureRate != 0.5 {
+		t.Errorf("unexpected health for our remaining endpoint: %+v", health[1])
+	}
+}
+
+func TestEndpointRetry(t *testing.T) {
+	site := newValidatorSite(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+	good, broken := site.URL+"/ip", site.URL+"/json"
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetValidationTimeout(2 * time.Second)
+	p5.SetCheckEndpoints([]string{good, broken})
+
+	sock, _ := p5.proxyMap.add(upstream.Addr().String())
+	for i := 0; i < 60; i++ {
+		if err := p5.ipEchoCheck(sock, ProtoHTTP); err != nil {
+			t.Fatalf("expected our proxy to pass on another endpoint, got %v", err)
+		}
+	}
+	if sock.ProxiedIP != "203.0.113.7" {
+		t.Errorf("expected our exit IP to come from the working endpoint, got %q", sock.ProxiedIP)
+	}
+
+	health := p5.GetEndpointHealth()
+	if len(health) != 2 || health[0].Endpoint != good || health[1].Endpoint != broken {
+		t.Fatalf("unexpected endpoint health: %+v", health)
+	}
+	if health[0].Failures != 0 || health[0].Successes == 0 || health[0].Quarantined {
+		t.Errorf("unexpected health for our working endpoint: %+v", health[0])
+	}
+	if !health[1].Quarantined {
+		t.Fatalf("expected our broken endpoint to be quarantined: %+v", health[1])
+	}
+	for i := 0; i < 10; i++ {
+		if endpoint := p5.GetRandomEndpoint(); endpoint != good {
+			t.Fatalf("expected quarantined endpoints to be skipped, got %s", endpoint)
+		}
+	}
+}
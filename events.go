@@ -0,0 +1,170 @@
+package prox5
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType identifies what happened in an Event.
+type EventType uint8
+
+const (
+	// EventLoaded is sent when a proxy is loaded into our map, see LoadSingleProxy and LoadState.
+	EventLoaded EventType = iota + 1
+	// EventValidated is sent when a proxy passes validation.
+	EventValidated
+	// EventValidationFailed is sent when a proxy fails validation, Err holds the reason if known.
+	EventValidationFailed
+	// EventStale is sent when a proxy is skipped while dispensing because it has gone stale.
+	EventStale
+	// EventRemoved is sent when a proxy is removed from our map, either for failing too often or by RemoveProxy.
+	EventRemoved
+	// EventDispensed is sent when a proxy is dispensed by one of our getters.
+	EventDispensed
+	// EventDialSucceeded is sent when one of our dialers connects to Target through a proxy.
+	EventDialSucceeded
+	// EventDialFailed is sent when one of our dialers fails to connect to Target through a proxy, Err holds the reason.
+	EventDialFailed
+	// EventScaled is sent when the AutoScaler changes the size of our validation worker pool to Workers.
+	EventScaled
+	// EventUntrusted is sent when a proxy is caught tampering with our checks, see SetExitConsensus.
+	EventUntrusted
+)
+
+var eventTypeStrings = map[EventType]string{
+	EventLoaded:           "loaded",
+	EventValidated:        "validated",
+	EventValidationFailed: "validation_failed",
+	EventStale:            "stale",
+	EventRemoved:          "removed",
+	EventDispensed:        "dispensed",
+	EventDialSucceeded:    "dial_succeeded",
+	EventDialFailed:       "dial_failed",
+	EventScaled:           "scaled",
+	EventUntrusted:        "untrusted",
+}
+
+func (et EventType) String() string {
+	if s, ok := eventTypeStrings[et]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// Event describes a change in the lifecycle of a proxy, or of the ProxyEngine itself. See ProxyEngine.Subscribe.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Proxy is the proxy the event is about, nil for EventScaled.
+	Proxy *Proxy
+	// Target is the address dialed, only set for dial events.
+	Target string
+	// Err is the reason for failure events, if known.
+	Err error
+	// Workers is the new size of our validation worker pool, only set for EventScaled.
+	Workers int
+}
+
+// EventFilter decides which events a subscriber receives. Return true to receive the event.
+// A nil EventFilter receives every event.
+type EventFilter func(Event) bool
+
+// EventTypes returns an EventFilter that only accepts events of the given types.
+func EventTypes(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// eventBufferSize is how many events a subscriber may fall behind by before it starts missing them.
+const eventBufferSize = 256
+
+type subscriber struct {
+	ch      chan Event
+	filter  EventFilter
+	dropped *atomic.Int64
+}
+
+// eventBus fans our events out to subscribers.
+type eventBus struct {
+	subs   map[<-chan Event]*subscriber
+	count  *atomic.Int32
+	closed bool
+	mu     *sync.RWMutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[<-chan Event]*subscriber), count: &atomic.Int32{}, mu: &sync.RWMutex{}}
+}
+
+// publish sends e to every interested subscriber. Subscribers that have fallen behind miss the event, we never block.
+func (eb *eventBus) publish(e Event) {
+	if eb.count.Load() == 0 {
+		return
+	}
+	e.Time = time.Now()
+	eb.mu.RLock()
+	defer eb.mu.RUnlock()
+	for _, sub := range eb.subs {
+		if sub.filter != nil && !sub.filter(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+func (eb *eventBus) closeAll() {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	for ch, sub := range eb.subs {
+		close(sub.ch)
+		delete(eb.subs, ch)
+	}
+	eb.count.Store(0)
+	eb.closed = true
+}
+
+// Subscribe returns a channel that receives the events accepted by filter, or every event if filter is nil.
+// The channel is buffered, events that arrive while it is full are dropped rather than slowing us down.
+// The channel is closed by Unsubscribe, or when the ProxyEngine is closed.
+func (p5 *ProxyEngine) Subscribe(filter EventFilter) <-chan Event {
+	sub := &subscriber{ch: make(chan Event, eventBufferSize), filter: filter, dropped: &atomic.Int64{}}
+	p5.events.mu.Lock()
+	defer p5.events.mu.Unlock()
+	if p5.events.closed {
+		close(sub.ch)
+		return sub.ch
+	}
+	p5.events.subs[sub.ch] = sub
+	p5.events.count.Add(1)
+	return sub.ch
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe and closes it.
+// It returns how many events the subscriber missed because it fell behind.
+func (p5 *ProxyEngine) Unsubscribe(ch <-chan Event) (dropped int64) {
+	p5.events.mu.Lock()
+	defer p5.events.mu.Unlock()
+	sub, ok := p5.events.subs[ch]
+	if !ok {
+		return 0
+	}
+	delete(p5.events.subs, ch)
+	p5.events.count.Add(-1)
+	close(sub.ch)
+	return sub.dropped.Load()
+}
+
+func (p5 *ProxyEngine) emit(t EventType, sock *Proxy) {
+	p5.events.publish(Event{Type: t, Proxy: sock})
+}
@@ -0,0 +1,85 @@
+package prox5
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestSubscribe(t *testing.T) {
+	p5 := NewProxyEngine()
+	all := p5.Subscribe(nil)
+	lifecycle := p5.Subscribe(EventTypes(EventLoaded, EventRemoved))
+
+	if !p5.LoadSingleProxy("127.0.0.1:1080") {
+		t.Fatal("failed to load proxy")
+	}
+	if e := nextEvent(t, lifecycle); e.Type != EventLoaded || e.Proxy.Endpoint != "127.0.0.1:1080" {
+		t.Errorf("unexpected event: %s %v", e.Type, e.Proxy)
+	}
+
+	addValidatedProxy(t, p5, "127.0.0.2:1080", ProtoSOCKS5)
+	if _, err := p5.TryGetAnyProxy(); err != nil {
+		t.Fatal(err)
+	}
+	if !p5.RemoveProxy("127.0.0.1:1080") {
+		t.Fatal("failed to remove proxy")
+	}
+	if e := nextEvent(t, lifecycle); e.Type != EventRemoved {
+		t.Errorf("expected removal event, got %s", e.Type)
+	}
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, nextEvent(t, all).Type.String())
+	}
+	if strings.Join(got, ",") != "loaded,dispensed,removed" {
+		t.Errorf("unexpected event sequence: %v", got)
+	}
+
+	if dropped := p5.Unsubscribe(all); dropped != 0 {
+		t.Errorf("expected no dropped events, got %d", dropped)
+	}
+	if _, open := <-all; open {
+		t.Error("expected channel to be closed after unsubscribing")
+	}
+
+	_ = p5.Close()
+	if _, open := <-lifecycle; open {
+		t.Error("expected channel to be closed when the engine closes")
+	}
+}
+
+func TestDialEvents(t *testing.T) {
+	echo := newIPEchoServer(t)
+	dp := newDummyHTTPProxy(t, "", "")
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	addValidatedProxy(t, p5, dp.Addr().String(), ProtoHTTP)
+	dials := p5.Subscribe(EventTypes(EventDialSucceeded, EventDialFailed))
+
+	target := strings.TrimPrefix(echo, "http://")
+	conn, err := p5.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if e := nextEvent(t, dials); e.Type != EventDialSucceeded || e.Target != target || e.Proxy.Endpoint != dp.Addr().String() {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
@@ -0,0 +1,164 @@
+package prox5
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// exitIndex keeps track of which of our proxies exit through which IP address,
+// and which exit IPs are currently held by a Lease. See EnableDistinctExits.
+type exitIndex struct {
+	byExit map[string]map[string]struct{}
+	leased map[string]struct{}
+	mu     *sync.Mutex
+}
+
+func newExitIndex() *exitIndex {
+	return &exitIndex{
+		byExit: make(map[string]map[string]struct{}),
+		leased: make(map[string]struct{}),
+		mu:     &sync.Mutex{},
+	}
+}
+
+func (ei *exitIndex) unlink(endpoint, exit string) {
+	if peers, ok := ei.byExit[exit]; ok {
+		delete(peers, endpoint)
+		if len(peers) == 0 {
+			delete(ei.byExit, exit)
+		}
+	}
+}
+
+// record sets the exit IP of sock, counting it as a rotation if sock was known to exit elsewhere before.
+func (ei *exitIndex) record(sock *Proxy, exit string) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	old := sock.ProxiedIP
+	if old != "" && old != exit {
+		atomic.AddInt64(&sock.exitChanges, 1)
+		ei.unlink(sock.Endpoint, old)
+	}
+	sock.ProxiedIP = exit
+	if exit == "" {
+		return
+	}
+	if _, ok := ei.byExit[exit]; !ok {
+		ei.byExit[exit] = make(map[string]struct{})
+	}
+	ei.byExit[exit][sock.Endpoint] = struct{}{}
+}
+
+// forget removes sock from the index, see proxyMap.delete.
+func (ei *exitIndex) forget(sock *Proxy) {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	ei.unlink(sock.Endpoint, sock.ProxiedIP)
+}
+
+func (ei *exitIndex) clear() {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	ei.byExit = make(map[string]map[string]struct{})
+}
+
+// peers returns the other endpoints that exit through the same IP as sock.
+func (ei *exitIndex) peers(sock *Proxy) []string {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	var peers []string
+	for endpoint := range ei.byExit[sock.ProxiedIP] {
+		if endpoint != sock.Endpoint {
+			peers = append(peers, endpoint)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// leasable reports whether sock can be leased without sharing its exit IP with an outstanding Lease.
+// Proxies with an unknown or rotating exit are never leasable, we can't vouch for where they'll come out.
+func (ei *exitIndex) leasable(sock *Proxy) bool {
+	if sock.RotatesExit() {
+		return false
+	}
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	if sock.ProxiedIP == "" {
+		return false
+	}
+	_, held := ei.leased[sock.ProxiedIP]
+	return !held
+}
+
+// exit returns the exit IP of sock, ProxiedIP is only ever written under ei.mu.
+func (ei *exitIndex) exit(sock *Proxy) string {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	return sock.ProxiedIP
+}
+
+// reserve claims the exit IP of sock for a Lease, returning false if it is already held.
+func (ei *exitIndex) reserve(exit string) bool {
+	ei.mu.Lock()
+	defer ei.mu.Unlock()
+	if _, held := ei.leased[exit]; held {
+		return false
+	}
+	ei.leased[exit] = struct{}{}
+	return true
+}
+
+func (ei *exitIndex) unreserve(exit string) {
+	ei.mu.Lock()
+	delete(ei.leased, exit)
+	ei.mu.Unlock()
+}
+
+// GetExitIP retrieves the IP address the Proxy was last seen exiting through, same as ProxiedIP.
+// Unlike reading ProxiedIP, it is safe to call while the Proxy is being validated.
+func (sock *Proxy) GetExitIP() string {
+	if sock.parent == nil {
+		return sock.ProxiedIP
+	}
+	return sock.parent.exits.exit(sock)
+}
+
+// GetExitChanges retrieves how many times the Proxy was seen exiting through a different IP address than the time before.
+func (sock *Proxy) GetExitChanges() int64 {
+	return atomic.LoadInt64(&sock.exitChanges)
+}
+
+// RotatesExit returns true if the Proxy has been seen exiting through more than one IP address.
+func (sock *Proxy) RotatesExit() bool {
+	return sock.GetExitChanges() > 0
+}
+
+// GetExitPeers retrieves the other endpoints we know of that exit through the same IP address as the Proxy,
+// e.g. different ports of the same backconnect gateway.
+func (sock *Proxy) GetExitPeers() []string {
+	if sock.parent == nil {
+		return nil
+	}
+	return sock.parent.exits.peers(sock)
+}
+
+// SharesExit returns true if any other endpoint we know of exits through the same IP address as the Proxy.
+func (sock *Proxy) SharesExit() bool {
+	return len(sock.GetExitPeers()) > 0
+}
+
+// GetExitGroups retrieves every known exit IP address along with the endpoints that exit through it.
+func (p5 *ProxyEngine) GetExitGroups() map[string][]string {
+	p5.exits.mu.Lock()
+	defer p5.exits.mu.Unlock()
+	groups := make(map[string][]string, len(p5.exits.byExit))
+	for exit, endpoints := range p5.exits.byExit {
+		for endpoint := range endpoints {
+			groups[exit] = append(groups[exit], endpoint)
+		}
+		sort.Strings(groups[exit])
+	}
+	return groups
+}
@@ -0,0 +1,119 @@
+package prox5
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExitIndex(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+
+	a := addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS5)
+	b := addValidatedProxy(t, p5, "127.0.0.1:1081", ProtoSOCKS5)
+	c := addValidatedProxy(t, p5, "127.0.0.1:1082", ProtoSOCKS5)
+
+	p5.exits.record(a, "1.1.1.1")
+	p5.exits.record(b, "1.1.1.1")
+	p5.exits.record(c, "2.2.2.2")
+
+	if !a.SharesExit() || !b.SharesExit() {
+		t.Fatal("expected a and b to share an exit")
+	}
+	if c.SharesExit() {
+		t.Fatal("c should not share an exit")
+	}
+	if peers := a.GetExitPeers(); len(peers) != 1 || peers[0] != b.Endpoint {
+		t.Fatalf("unexpected peers for a: %v", peers)
+	}
+	if groups := p5.GetExitGroups(); len(groups) != 2 || len(groups["1.1.1.1"]) != 2 {
+		t.Fatalf("unexpected exit groups: %v", groups)
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		p5.exits.record(c, "2.2.2.2")
+		if c.RotatesExit() {
+			t.Fatal("seeing the same exit again should not count as a rotation")
+		}
+		p5.exits.record(b, "3.3.3.3")
+		if !b.RotatesExit() || b.GetExitChanges() != 1 {
+			t.Fatalf("expected one exit change for b, got %d", b.GetExitChanges())
+		}
+		if a.SharesExit() {
+			t.Fatal("a should no longer share an exit with b")
+		}
+		if b.GetExitIP() != "3.3.3.3" {
+			t.Fatalf("unexpected exit for b: %s", b.GetExitIP())
+		}
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		p5.exits.record(a, "2.2.2.2")
+		if !c.SharesExit() {
+			t.Fatal("expected c to share an exit with a")
+		}
+		if !p5.RemoveProxy(a.Endpoint) {
+			t.Fatal("failed to remove a")
+		}
+		if c.SharesExit() {
+			t.Fatal("removed proxies should be dropped from the exit index")
+		}
+	})
+}
+
+func TestDistinctExits(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.EnableDistinctExits()
+
+	a := addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS5)
+	b := addValidatedProxy(t, p5, "127.0.0.1:1081", ProtoSOCKS5)
+	rotating := addValidatedProxy(t, p5, "127.0.0.1:1082", ProtoSOCKS5)
+	addValidatedProxy(t, p5, "127.0.0.1:1083", ProtoSOCKS5)
+
+	p5.exits.record(a, "1.1.1.1")
+	p5.exits.record(b, "1.1.1.1")
+	p5.exits.record(rotating, "2.2.2.2")
+	p5.exits.record(rotating, "3.3.3.3")
+
+	first, err := p5.TryAcquire(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Proxy.GetExitIP() != "1.1.1.1" {
+		t.Fatalf("expected a proxy exiting through 1.1.1.1, got %s", first.Proxy.Endpoint)
+	}
+
+	if _, err = p5.TryAcquire(nil); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected no proxies while the only known stable exit is leased, got %v", err)
+	}
+
+	if err = first.Release(Outcome{Result: LeaseSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	second, err := p5.TryAcquire(nil)
+	if err != nil {
+		t.Fatalf("expected the exit to be free again after release: %v", err)
+	}
+	if second.Proxy.GetExitIP() != "1.1.1.1" {
+		t.Fatalf("rotating and unknown exits should not be leased, got %s", second.Proxy.Endpoint)
+	}
+	_ = second.Release(Outcome{Result: LeaseSuccess})
+
+	p5.DisableDistinctExits()
+	var leases []*Lease
+	for {
+		lease, err := p5.TryAcquire(nil)
+		if err != nil {
+			break
+		}
+		leases = append(leases, lease)
+	}
+	if len(leases) != 4 {
+		t.Fatalf("expected every proxy to be leasable with distinct exits disabled, got %d", len(leases))
+	}
+}
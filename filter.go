@@ -0,0 +1,82 @@
+package prox5
+
+import "context"
+
+// ProxyFilter is used to narrow down which proxies are eligible to be dispensed. Return true to accept the proxy.
+// A nil ProxyFilter accepts any proxy.
+type ProxyFilter func(*Proxy) bool
+
+// allFilters combines filters into a single ProxyFilter that accepts a proxy only if every one of them does.
+// nil filters are ignored, if none remain the result is nil.
+func allFilters(filters ...ProxyFilter) ProxyFilter {
+	var active []ProxyFilter
+	for _, f := range filters {
+		if f != nil {
+			active = append(active, f)
+		}
+	}
+	switch len(active) {
+	case 0:
+		return nil
+	case 1:
+		return active[0]
+	}
+	return func(sock *Proxy) bool {
+		for _, f := range active {
+			if !f(sock) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MinAnonymity returns a ProxyFilter that only accepts proxies judged to be at least as anonymous as level.
+func MinAnonymity(level AnonymityLevel) ProxyFilter {
+	return func(sock *Proxy) bool {
+		return sock.GetAnonymity() >= level
+	}
+}
+
+// InProtocols returns a ProxyFilter that only accepts proxies of the given protocols.
+func InProtocols(protos ...ProxyProtocol) ProxyFilter {
+	return func(sock *Proxy) bool {
+		got := sock.GetProto()
+		for _, proto := range protos {
+			if got == proto {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type filterCtxKey struct{}
+
+// WithFilter returns a copy of ctx that makes our context aware getters and dialers only dispense proxies that satisfy filter,
+// on top of any filter set with SetDispenseFilter. e.g. p5.DialContext(WithFilter(ctx, InCountries("DE")), "tcp", addr)
+func WithFilter(ctx context.Context, filter ProxyFilter) context.Context {
+	if existing := FilterFromContext(ctx); existing != nil {
+		filter = allFilters(existing, filter)
+	}
+	return context.WithValue(ctx, filterCtxKey{}, filter)
+}
+
+// FilterFromContext retrieves the ProxyFilter carried by ctx, or nil if there is none. See WithFilter.
+func FilterFromContext(ctx context.Context) ProxyFilter {
+	filter, _ := ctx.Value(filterCtxKey{}).(ProxyFilter)
+	return filter
+}
+
+// engineFilter combines filter with any filtering required by our options, see SetMinAnonymity and SetDispenseFilter.
+func (p5 *ProxyEngine) engineFilter(filter ProxyFilter) ProxyFilter {
+	var required ProxyFilter
+	if level := p5.GetMinAnonymity(); level > AnonymityUnknown {
+		required = MinAnonymity(level)
+	}
+	var intercepting ProxyFilter
+	if !p5.GetInterceptingProxiesStatus() {
+		intercepting = NotIntercepting
+	}
+	return allFilters(required, intercepting, p5.GetDispenseFilter(), filter)
+}
@@ -0,0 +1,252 @@
+package prox5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoInfo is what our GeoIP databases know about the exit IP of a proxy, see SetGeoIPDatabase.
+// Fields the databases have no answer for are left empty.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, e.g. "US".
+	Country string `json:"country,omitempty"`
+	// City is the English name of the city.
+	City string `json:"city,omitempty"`
+	// ASN is the number of the autonomous system the IP belongs to.
+	ASN uint `json:"asn,omitempty"`
+	// Organization is the organization that operates the autonomous system.
+	Organization string `json:"organization,omitempty"`
+}
+
+// mmdbRecord covers the fields we use from the GeoIP2/GeoLite2 City, Country, and ASN databases.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoResolver looks up what is known about an IP address.
+type geoResolver interface {
+	lookup(ip net.IP) (GeoInfo, error)
+	Close() error
+}
+
+// mmdbResolver resolves IP addresses against local mmdb files, merging the answers of each.
+type mmdbResolver struct {
+	readers []*maxminddb.Reader
+}
+
+func openMMDB(paths ...string) (*mmdbResolver, error) {
+	res := &mmdbResolver{}
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			_ = res.Close()
+			return nil, fmt.Errorf("failed to open GeoIP database %s: %w", path, err)
+		}
+		res.readers = append(res.readers, reader)
+	}
+	return res, nil
+}
+
+func (res *mmdbResolver) lookup(ip net.IP) (GeoInfo, error) {
+	var info GeoInfo
+	for _, reader := range res.readers {
+		var record mmdbRecord
+		if err := reader.Lookup(ip, &record); err != nil {
+			return info, err
+		}
+		if info.Country == "" {
+			info.Country = record.Country.ISOCode
+		}
+		if info.Country == "" {
+			info.Country = record.RegisteredCountry.ISOCode
+		}
+		if info.City == "" {
+			info.City = record.City.Names["en"]
+		}
+		if info.ASN == 0 {
+			info.ASN = record.ASN
+		}
+		if info.Organization == "" {
+			info.Organization = record.Organization
+		}
+	}
+	return info, nil
+}
+
+func (res *mmdbResolver) Close() error {
+	var err error
+	for _, reader := range res.readers {
+		if closeErr := reader.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// geoDB holds our current geoResolver. The lock keeps a resolver from being closed in the middle of a lookup.
+type geoDB struct {
+	resolver geoResolver
+	paths    []string
+	mu       *sync.RWMutex
+}
+
+func newGeoDB() *geoDB {
+	return &geoDB{mu: &sync.RWMutex{}}
+}
+
+func (gdb *geoDB) swap(resolver geoResolver, paths []string) {
+	gdb.mu.Lock()
+	old := gdb.resolver
+	gdb.resolver = resolver
+	gdb.paths = paths
+	gdb.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+func (gdb *geoDB) lookup(ip net.IP) (GeoInfo, bool) {
+	gdb.mu.RLock()
+	defer gdb.mu.RUnlock()
+	if gdb.resolver == nil {
+		return GeoInfo{}, false
+	}
+	info, err := gdb.resolver.lookup(ip)
+	return info, err == nil
+}
+
+// SetGeoIPDatabase loads one or more local MaxMind (or compatible) mmdb files used to look up the country, city, ASN and
+// organization of the exit IP of each proxy after it is validated. Answers from the databases are merged, so a City and
+// an ASN database can be used together. Proxies we already know the exit IP of are looked up right away.
+// Calling SetGeoIPDatabase without any paths disables lookups. No network access is involved.
+func (p5 *ProxyEngine) SetGeoIPDatabase(paths ...string) error {
+	if len(paths) == 0 {
+		p5.geo.swap(nil, nil)
+		p5.DebugLogger.Printf("prox5 GeoIP lookups disabled")
+		return nil
+	}
+	resolver, err := openMMDB(paths...)
+	if err != nil {
+		return err
+	}
+	p5.geo.swap(resolver, append([]string{}, paths...))
+	p5.DebugLogger.Printf("prox5 GeoIP database set to %s", strings.Join(paths, ", "))
+	for tuple := range p5.proxyMap.plot.IterBuffered() {
+		p5.enrichGeo(tuple.Val)
+	}
+	return nil
+}
+
+// GetGeoIPDatabase returns the paths of the GeoIP databases currently in use, see SetGeoIPDatabase.
+func (p5 *ProxyEngine) GetGeoIPDatabase() []string {
+	p5.geo.mu.RLock()
+	defer p5.geo.mu.RUnlock()
+	return append([]string{}, p5.geo.paths...)
+}
+
+// enrichGeo looks up the exit IP of sock in our GeoIP databases, if we have any.
+func (p5 *ProxyEngine) enrichGeo(sock *Proxy) {
+	ip := net.ParseIP(sock.GetExitIP())
+	if ip == nil {
+		return
+	}
+	info, ok := p5.geo.lookup(ip)
+	if !ok {
+		// whatever we knew may be about a previous exit IP
+		sock.geo.Store(nil)
+		return
+	}
+	sock.geo.Store(&info)
+}
+
+// GetGeo retrieves what our GeoIP databases know about the exit IP of the Proxy.
+// ok is false if the Proxy has not been looked up, see ProxyEngine.SetGeoIPDatabase.
+func (sock *Proxy) GetGeo() (info GeoInfo, ok bool) {
+	if stored := sock.geo.Load(); stored != nil {
+		return *stored, true
+	}
+	return GeoInfo{}, false
+}
+
+// InCountries returns a ProxyFilter that only accepts proxies exiting in one of the given countries (ISO 3166-1 alpha-2 codes).
+// Proxies with an unknown country are rejected.
+func InCountries(codes ...string) ProxyFilter {
+	return func(sock *Proxy) bool {
+		info, ok := sock.GetGeo()
+		if !ok || info.Country == "" {
+			return false
+		}
+		for _, code := range codes {
+			if strings.EqualFold(code, info.Country) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ExcludeCountries returns a ProxyFilter that rejects proxies exiting in any of the given countries (ISO 3166-1 alpha-2 codes).
+func ExcludeCountries(codes ...string) ProxyFilter {
+	in := InCountries(codes...)
+	return func(sock *Proxy) bool {
+		return !in(sock)
+	}
+}
+
+// InASNs returns a ProxyFilter that only accepts proxies exiting through one of the given autonomous systems.
+// Proxies with an unknown ASN are rejected.
+func InASNs(asns ...uint) ProxyFilter {
+	return func(sock *Proxy) bool {
+		info, ok := sock.GetGeo()
+		if !ok || info.ASN == 0 {
+			return false
+		}
+		for _, asn := range asns {
+			if asn == info.ASN {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ExcludeASNs returns a ProxyFilter that rejects proxies exiting through any of the given autonomous systems,
+// e.g. those of hosting providers to keep datacenter exits out.
+func ExcludeASNs(asns ...uint) ProxyFilter {
+	in := InASNs(asns...)
+	return func(sock *Proxy) bool {
+		return !in(sock)
+	}
+}
+
+// ExcludeOrganizations returns a ProxyFilter that rejects proxies whose autonomous system organization contains
+// any of the given substrings, case insensitively. e.g. ExcludeOrganizations("amazon", "digitalocean", "ovh")
+func ExcludeOrganizations(substrings ...string) ProxyFilter {
+	return func(sock *Proxy) bool {
+		info, ok := sock.GetGeo()
+		if !ok {
+			return true
+		}
+		org := strings.ToLower(info.Organization)
+		for _, sub := range substrings {
+			if sub != "" && strings.Contains(org, strings.ToLower(sub)) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,104 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeGeoResolver map[string]GeoInfo
+
+func (f fakeGeoResolver) lookup(ip net.IP) (GeoInfo, error) {
+	info, ok := f[ip.String()]
+	if !ok {
+		return GeoInfo{}, errors.New("not found")
+	}
+	return info, nil
+}
+
+func (f fakeGeoResolver) Close() error {
+	return nil
+}
+
+func TestGeoEnrichment(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+
+	if err := p5.SetGeoIPDatabase(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Fatal("expected an error for a missing database")
+	}
+
+	p5.geo.swap(fakeGeoResolver{
+		"1.1.1.1": {Country: "US", City: "Los Angeles", ASN: 13335, Organization: "CLOUDFLARENET"},
+		"2.2.2.2": {Country: "DE", City: "Berlin", ASN: 3320, Organization: "Deutsche Telekom AG"},
+	}, nil)
+
+	us := addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS5)
+	de := addValidatedProxy(t, p5, "127.0.0.1:1081", ProtoSOCKS5)
+	unknown := addValidatedProxy(t, p5, "127.0.0.1:1082", ProtoSOCKS5)
+	for sock, ip := range map[*Proxy]string{us: "1.1.1.1", de: "2.2.2.2", unknown: "3.3.3.3"} {
+		p5.exits.record(sock, ip)
+		p5.enrichGeo(sock)
+	}
+
+	if info, ok := us.GetGeo(); !ok || info.Country != "US" || info.ASN != 13335 {
+		t.Fatalf("unexpected geo for us: %+v (%t)", info, ok)
+	}
+	if _, ok := unknown.GetGeo(); ok {
+		t.Fatal("expected no geo for an IP missing from the database")
+	}
+
+	t.Run("filters", func(t *testing.T) {
+		cases := []struct {
+			name   string
+			filter ProxyFilter
+			want   map[*Proxy]bool
+		}{
+			{"InCountries", InCountries("us"), map[*Proxy]bool{us: true, de: false, unknown: false}},
+			{"ExcludeCountries", ExcludeCountries("US"), map[*Proxy]bool{us: false, de: true, unknown: true}},
+			{"InASNs", InASNs(3320), map[*Proxy]bool{us: false, de: true, unknown: false}},
+			{"ExcludeASNs", ExcludeASNs(13335), map[*Proxy]bool{us: false, de: true, unknown: true}},
+			{"ExcludeOrganizations", ExcludeOrganizations("cloudflare"), map[*Proxy]bool{us: false, de: true, unknown: true}},
+		}
+		for _, c := range cases {
+			for sock, want := range c.want {
+				if got := c.filter(sock); got != want {
+					t.Errorf("%s(%s) = %t, want %t", c.name, sock.Endpoint, got, want)
+				}
+			}
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		sock, err := p5.GetAnyProxyContext(WithFilter(ctx, InCountries("DE")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sock != de {
+			t.Fatalf("expected %s, got %s", de.Endpoint, sock.Endpoint)
+		}
+		p5.enqueue(sock)
+	})
+
+	t.Run("engine", func(t *testing.T) {
+		p5.SetDispenseFilter(InCountries("US"))
+		defer p5.SetDispenseFilter(nil)
+		for i := 0; i < 3; i++ {
+			sock, err := p5.TryGetAnySOCKS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sock != us {
+				t.Fatalf("expected only %s to be dispensed, got %s", us.Endpoint, sock.Endpoint)
+			}
+			p5.enqueue(sock)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package prox5
 
 import (
+	"crypto/x509"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -22,11 +23,31 @@ func (p5 *ProxyEngine) RandomUserAgent() string {
 	return entropy.RandomStrChoice(p5.opt.userAgents)
 }
 
-// GetRandomEndpoint returns a random whatismyip style endpoint from our ProxyEngine's options
+// GetRandomEndpoint returns a random whatismyip style endpoint from our ProxyEngine's options,
+// skipping those that are quarantined. See GetEndpointHealth.
 func (p5 *ProxyEngine) GetRandomEndpoint() string {
+	return p5.pickEndpoint()
+}
+
+// GetJudgeEndpoint returns the endpoint used to judge the anonymity of proxies, see SetJudgeEndpoint.
+func (p5 *ProxyEngine) GetJudgeEndpoint() string {
 	p5.mu.RLock()
 	defer p5.mu.RUnlock()
-	return entropy.RandomStrChoice(p5.opt.checkEndpoints)
+	return p5.opt.judgeEndpoint
+}
+
+// GetMinAnonymity returns the minimum anonymity level a proxy must have to be dispensed, see SetMinAnonymity.
+func (p5 *ProxyEngine) GetMinAnonymity() AnonymityLevel {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.minAnonymity
+}
+
+// GetAutoSave returns the file our state is periodically saved to and how often, see SetAutoSave.
+func (p5 *ProxyEngine) GetAutoSave() (path string, interval time.Duration) {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.autosavePath, p5.opt.autosaveInterval
 }
 
 // GetStaleTime returns the duration of time after which a proxy will be considered "stale".
@@ -36,6 +57,99 @@ func (p5 *ProxyEngine) GetStaleTime() time.Duration {
 	return p5.opt.stale
 }
 
+// GetSessionTTL returns how long a sticky session may hold on to the same proxy, see SetSessionTTL.
+func (p5 *ProxyEngine) GetSessionTTL() time.Duration {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.sessionTTL
+}
+
+// GetServerStickySessionStatus returns whether or not each client of our servers is given a sticky session.
+func (p5 *ProxyEngine) GetServerStickySessionStatus() bool {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.serverStickySessions
+}
+
+// GetUDPProbeStatus returns whether or not SOCKS5 proxies are checked for UDP support during validation.
+func (p5 *ProxyEngine) GetUDPProbeStatus() bool {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.udpProbe
+}
+
+// GetUDPProbeTarget returns the DNS server queried by our UDP probe, see SetUDPProbeTarget.
+func (p5 *ProxyEngine) GetUDPProbeTarget() string {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.udpProbeTarget
+}
+
+// GetChainLength returns how many proxies from our pool each dial tunnels through, see SetChainLength.
+func (p5 *ProxyEngine) GetChainLength() int {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.chainLength
+}
+
+// GetChainPrefix returns the fixed hops every dial goes through before those from our pool, see SetChainPrefix.
+func (p5 *ProxyEngine) GetChainPrefix() []string {
+	prefix := p5.chainPrefix()
+	hops := make([]string, 0, len(prefix))
+	for _, sock := range prefix {
+		hops = append(hops, sock.GetProto().String()+"://"+sock.Endpoint)
+	}
+	return hops
+}
+
+func (p5 *ProxyEngine) chainPrefix() []*Proxy {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.chainPrefix
+}
+
+// GetDispenseFilter returns the ProxyFilter every dispensed proxy must satisfy, see SetDispenseFilter.
+func (p5 *ProxyEngine) GetDispenseFilter() ProxyFilter {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.dispenseFilter
+}
+
+// GetValidators returns the validators that replace our default check, see SetValidators.
+func (p5 *ProxyEngine) GetValidators() []Validator {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.validators
+}
+
+// GetExitConsensus returns how many of our check endpoints must agree on the exit IP of a proxy, see SetExitConsensus.
+func (p5 *ProxyEngine) GetExitConsensus() int {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.exitConsensus
+}
+
+// GetUserStore returns the UserStore users of our servers authenticate against, see SetUserStore.
+func (p5 *ProxyEngine) GetUserStore() UserStore {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.userStore
+}
+
+// GetUsernameParamsStatus returns whether or not clients of our servers may pass routing parameters in their username.
+func (p5 *ProxyEngine) GetUsernameParamsStatus() bool {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.usernameParams
+}
+
+// GetDistinctExitsStatus returns whether or not concurrent leases are guaranteed to exit through different IP addresses.
+func (p5 *ProxyEngine) GetDistinctExitsStatus() bool {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.distinctExits
+}
+
 // GetValidationTimeout returns the current value of validationTimeout.
 func (p5 *ProxyEngine) GetValidationTimeout() time.Duration {
 	p5.opt.RLock()
@@ -120,6 +234,13 @@ func (p5 *ProxyEngine) GetDispenseMiddleware() func(*Proxy) (*Proxy, bool) {
 	return p5.dispenseMiddleware
 }
 
+// GetSelector retrieves the Selector used to pick proxies for dispensing, nil means proxies are dispensed in order.
+func (p5 *ProxyEngine) GetSelector() Selector {
+	p5.mu.RLock()
+	defer p5.mu.RUnlock()
+	return p5.selector
+}
+
 func (p5 *ProxyEngine) GetRecyclerShuffleStatus() bool {
 	p5.mu.RLock()
 	defer p5.mu.RUnlock()
@@ -141,7 +262,28 @@ func (p5 *ProxyEngine) GetDebugRedactStatus() bool {
 }
 
 func (p5 *ProxyEngine) GetHTTPTLSVerificationStatus() bool {
-	p5.mu.RLock()
-	defer p5.mu.RUnlock()
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
 	return p5.opt.tlsVerify
 }
+
+// GetValidationRootCAs returns the root CAs certificates are verified against during validation, see SetValidationRootCAs.
+func (p5 *ProxyEngine) GetValidationRootCAs() *x509.CertPool {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.tlsRoots
+}
+
+// GetEndpointPins returns the fingerprints we expect the certificate of endpoint to match, see SetEndpointPins.
+func (p5 *ProxyEngine) GetEndpointPins(endpoint string) []string {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.tlsPins[pinKey(endpoint)]
+}
+
+// GetInterceptingProxiesStatus returns whether or not we dispense proxies caught intercepting TLS, see Intercepting.
+func (p5 *ProxyEngine) GetInterceptingProxiesStatus() bool {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	return p5.opt.allowIntercepting
+}
@@ -0,0 +1,28 @@
+package prox5
+
+import "testing"
+
+// addValidatedProxy skips the network and places a proxy straight into the valid lists.
+func addValidatedProxy(t *testing.T, p5 *ProxyEngine, endpoint string, proto ProxyProtocol) *Proxy {
+	t.Helper()
+	sock, ok := p5.proxyMap.add(endpoint)
+	if !ok {
+		t.Fatalf("failed to add %s to proxy map", endpoint)
+	}
+	sock.protocol.set(proto)
+	sock.good()
+	if !p5.tally(sock) {
+		t.Fatalf("failed to tally %s", endpoint)
+	}
+	return sock
+}
+
+// mustGetProxy retrieves endpoint from the proxy map of p5.
+func mustGetProxy(t *testing.T, p5 *ProxyEngine, endpoint string) *Proxy {
+	t.Helper()
+	sock, ok := p5.proxyMap.plot.Get(endpoint)
+	if !ok {
+		t.Fatalf("%s is not in our proxy map", endpoint)
+	}
+	return sock
+}
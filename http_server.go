@@ -0,0 +1,361 @@
+package prox5
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are meaningful only to a single connection, they are not forwarded. See RFC 7230, section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// httpProxy is our rotating HTTP proxy server, see NewHTTPProxyServer.
+type httpProxy struct {
+	p5       *ProxyEngine
+	username string
+	password string
+	// transport forwards plain HTTP requests. Keep-alives are disabled so that every request is free to rotate.
+	transport *http.Transport
+
+	// tunnels are the hijacked client connections of our CONNECT tunnels, which http.Server no longer keeps track of.
+	tunnels map[net.Conn]struct{}
+	closing bool
+	mu      *sync.Mutex
+}
+
+func (p5 *ProxyEngine) newHTTPProxy(username, password string) *httpProxy {
+	return &httpProxy{
+		p5:       p5,
+		username: username,
+		password: password,
+		transport: &http.Transport{
+			DialContext:       p5.DialContext,
+			DisableKeepAlives: true,
+		},
+		tunnels: make(map[net.Conn]struct{}),
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (hp *httpProxy) track(conn net.Conn) bool {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	if hp.closing {
+		return false
+	}
+	hp.tunnels[conn] = struct{}{}
+	return true
+}
+
+func (hp *httpProxy) untrack(conn net.Conn) {
+	hp.mu.Lock()
+	delete(hp.tunnels, conn)
+	hp.mu.Unlock()
+}
+
+func (hp *httpProxy) active() int {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return len(hp.tunnels)
+}
+
+// closeTunnels refuses new tunnels from here on, and closes those already open if now is set.
+func (hp *httpProxy) closeTunnels(now bool) {
+	hp.mu.Lock()
+	hp.closing = true
+	var tunnels []net.Conn
+	if now {
+		for conn := range hp.tunnels {
+			tunnels = append(tunnels, conn)
+		}
+	}
+	hp.mu.Unlock()
+	for _, conn := range tunnels {
+		_ = conn.Close()
+	}
+}
+
+// authorized checks the client's credentials, see authenticateClient. The result is nil if authentication is disabled.
+func (hp *httpProxy) authorized(r *http.Request) (*serverAuth, bool) {
+	if hp.p5.GetUserStore() == nil && (hp.username == "" || hp.password == "") {
+		return nil, true
+	}
+	scheme, creds, ok := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(creds))
+	if err != nil {
+		return nil, false
+	}
+	user, pass, _ := strings.Cut(string(decoded), ":")
+	return hp.p5.authenticateClient(user, pass, hp.username, hp.password)
+}
+
+// admit holds the client's user to their policy for a request to target, responding with an error if they are refused.
+func (hp *httpProxy) admit(w http.ResponseWriter, auth *serverAuth, target string) bool {
+	if auth == nil || auth.grant == nil {
+		return true
+	}
+	if err := auth.grant.admit(target); err != nil {
+		hp.p5.DebugLogger.Printf("prox5 HTTP proxy server: %s to %s: %v", auth.base, target, err)
+		status := http.StatusTooManyRequests
+		if errors.Is(err, ErrPolicyDenied) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	return true
+}
+
+func (hp *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth, ok := hp.authorized(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="prox5"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		hp.tunnel(w, r, auth)
+		return
+	}
+	hp.forward(w, r, auth)
+}
+
+// tunnel handles CONNECT requests by splicing the client onto a connection dialed through our pool.
+func (hp *httpProxy) tunnel(w http.ResponseWriter, r *http.Request, auth *serverAuth) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	if !hp.admit(w, auth, r.Host) {
+		return
+	}
+	// the request context ends with this handler, the tunnel must outlive it.
+	ctx := context.Background()
+	var grant *userGrant
+	if auth != nil {
+		if grant = auth.grant; grant != nil {
+			defer grant.release()
+		}
+		ctx = auth.context(ctx)
+	}
+	ctx = hp.p5.clientSession(ctx, r.RemoteAddr)
+	upstream, err := hp.p5.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, rw, err := hijacker.Hijack()
+	if err != nil {
+		_ = upstream.Close()
+		return
+	}
+	if !hp.track(client) {
+		_ = client.Close()
+		_ = upstream.Close()
+		return
+	}
+	defer hp.untrack(client)
+	if grant != nil {
+		client = grantConn{Conn: client, grant: grant}
+	}
+	if _, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		_ = client.Close()
+		_ = upstream.Close()
+		return
+	}
+	// anything the client sent after its CONNECT request is already sitting in our reader.
+	if buffered := rw.Reader.Buffered(); buffered > 0 {
+		peeked, _ := rw.Reader.Peek(buffered)
+		if grant != nil {
+			_ = grant.count(len(peeked), 0)
+		}
+		if _, err = upstream.Write(peeked); err != nil {
+			_ = client.Close()
+			_ = upstream.Close()
+			return
+		}
+	}
+	go splice(upstream, client)
+	splice(client, upstream)
+}
+
+// splice copies from src to dst until either side is done, then closes both.
+func splice(dst, src net.Conn) {
+	buf := bufs.Get()
+	defer bufs.Put(buf)
+	_, _ = io.CopyBuffer(dst, src, buf[:cap(buf)])
+	_ = dst.Close()
+	_ = src.Close()
+}
+
+// forward handles plain HTTP requests with an absolute URI, sending them on through our pool.
+func (hp *httpProxy) forward(w http.ResponseWriter, r *http.Request, auth *serverAuth) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy server, requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	var grant *userGrant
+	if auth != nil {
+		target := r.URL.Host
+		if r.URL.Port() == "" {
+			port := "80"
+			if r.URL.Scheme == "https" {
+				port = "443"
+			}
+			target = net.JoinHostPort(r.URL.Hostname(), port)
+		}
+		if !hp.admit(w, auth, target) {
+			return
+		}
+		if grant = auth.grant; grant != nil {
+			defer grant.release()
+		}
+		ctx = auth.context(ctx)
+	}
+	out := r.Clone(hp.p5.clientSession(ctx, r.RemoteAddr))
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	if grant != nil && out.Body != nil && out.Body != http.NoBody {
+		out.Body = grantReader{ReadCloser: out.Body, grant: grant, in: true}
+	}
+
+	resp, err := hp.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	body := resp.Body
+	if grant != nil {
+		// stop as soon as the user runs out of quota rather than after the whole response.
+		body = grantReader{ReadCloser: resp.Body, grant: grant}
+	}
+	buf := bufs.Get()
+	defer bufs.Put(buf)
+	_, _ = io.CopyBuffer(w, body, buf[:cap(buf)])
+}
+
+// HTTPProxyServer is our rotating proxy HTTP server, see NewHTTPProxyServer.
+type HTTPProxyServer struct {
+	p5     *ProxyEngine
+	proxy  *httpProxy
+	server *http.Server
+}
+
+// NewHTTPProxyServer returns a handle to our rotating proxy HTTP server, which handles both CONNECT tunnels and plain
+// HTTP requests. See Serve and Shutdown.
+// Connections are made through our pool just like those of our SOCKS5 server, including sticky sessions when enabled.
+// username and password are used for Basic authentication to the server, leave either empty to disable it.
+// Users of our UserStore may authenticate too and are held to their policy, see SetUserStore.
+func (p5 *ProxyEngine) NewHTTPProxyServer(username, password string) *HTTPProxyServer {
+	hp := p5.newHTTPProxy(username, password)
+	return &HTTPProxyServer{
+		p5:    p5,
+		proxy: hp,
+		server: &http.Server{
+			Handler:           hp,
+			ReadHeaderTimeout: p5.GetServerTimeout(),
+		},
+	}
+}
+
+// Serve accepts connections on l until it fails or the server is shut down, in which case ErrServerClosed is returned.
+// Serve closes l when it returns.
+func (srv *HTTPProxyServer) Serve(l net.Listener) error {
+	buf := strs.Get()
+	buf.MustWriteString("listening for HTTP proxy connections on ")
+	buf.MustWriteString(l.Addr().String())
+	srv.p5.dbgPrint(buf)
+
+	if err := srv.server.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// ListenAndServe listens on the standard Go listen string listen, e.g: "127.0.0.1:8080", then calls Serve.
+func (srv *HTTPProxyServer) ListenAndServe(listen string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+// Shutdown stops accepting new connections and waits for active requests and tunnels to finish.
+// If ctx is done first, the remaining connections are closed and the context's error is returned.
+func (srv *HTTPProxyServer) Shutdown(ctx context.Context) error {
+	srv.proxy.closeTunnels(false)
+	if err := srv.server.Shutdown(ctx); err != nil {
+		_ = srv.Close()
+		return err
+	}
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for srv.proxy.active() > 0 {
+		select {
+		case <-ctx.Done():
+			srv.proxy.closeTunnels(true)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close stops accepting new connections and closes all active ones immediately.
+func (srv *HTTPProxyServer) Close() error {
+	srv.proxy.closeTunnels(true)
+	return srv.server.Close()
+}
+
+// StartHTTPProxyServer starts our rotating proxy HTTP server and blocks until it fails.
+// listen is standard Go listen string, e.g: "127.0.0.1:8080".
+// username and password are used for Basic authentication to the server, leave either empty to disable it.
+// See NewHTTPProxyServer for a server that can be stopped.
+func (p5 *ProxyEngine) StartHTTPProxyServer(listen, username, password string) error {
+	return p5.NewHTTPProxyServer(username, password).ListenAndServe(listen)
+}
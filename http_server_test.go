@@ -0,0 +1,170 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxyServer(t *testing.T) {
+	echo := newIPEchoServer(t)
+	target := strings.TrimPrefix(echo, "http://")
+	first, second := newDummyHTTPProxy(t, "", ""), newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	addValidatedProxy(t, p5, first.Addr().String(), ProtoHTTP)
+	addValidatedProxy(t, p5, second.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	srv := httptest.NewServer(p5.newHTTPProxy("user", "pass"))
+	defer srv.Close()
+	proxyAddr := strings.TrimPrefix(srv.URL, "http://")
+
+	// dispensed proxies leave our valid lists until revalidated, put both back before each subtest.
+	refill := func() {
+		p5.Valids.HTTP.Lock()
+		p5.Valids.HTTP.Init()
+		p5.Valids.HTTP.Unlock()
+		for _, dp := range []*dummyHTTPProxy{first, second} {
+			p5.enqueue(mustGetProxy(t, p5, dp.Addr().String()))
+		}
+	}
+
+	client := func(user string) *http.Client {
+		proxyURL, _ := url.Parse("http://" + user + "@" + proxyAddr)
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		resp, err := client("user:wrong").Get(echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Fatalf("expected %d, got %d", http.StatusProxyAuthRequired, resp.StatusCode)
+		}
+		if first.tunnels.Load()+second.tunnels.Load() != 0 {
+			t.Fatal("unauthorized requests should not reach our pool")
+		}
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		resp, err := client("user:pass").Get(echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "127.0.0.1" {
+			t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+		}
+		if first.tunnels.Load()+second.tunnels.Load() != 1 {
+			t.Fatal("expected the request to go through our pool")
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		refill()
+		conn, err := dialTestHTTP("user:pass@"+proxyAddr, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		if _, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + target + "\r\nConnection: close\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(conn)
+		if !strings.HasSuffix(string(body), "127.0.0.1") {
+			t.Fatalf("unexpected response through tunnel: %q", body)
+		}
+		if first.tunnels.Load()+second.tunnels.Load() != 2 {
+			t.Fatal("expected the tunnel to go through our pool")
+		}
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		p5.EnableServerStickySessions()
+		defer p5.DisableServerStickySessions()
+		refill()
+		before := first.tunnels.Load() + second.tunnels.Load()
+		firstBefore := first.tunnels.Load()
+		for i := 0; i < 3; i++ {
+			resp, err := client("user:pass").Get(echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+		}
+		if got := first.tunnels.Load() + second.tunnels.Load() - before; got != 3 {
+			t.Fatalf("expected 3 requests through our pool, got %d", got)
+		}
+		if used := first.tunnels.Load() - firstBefore; used != 0 && used != 3 {
+			t.Fatalf("expected every request to leave through the same proxy, got %d of 3 through the first", used)
+		}
+	})
+}
+
+func TestHTTPProxyServerShutdown(t *testing.T) {
+	target := newTCPEchoServer(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := p5.NewHTTPProxyServer("", "")
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	lingering, err := dialTestHTTP(ln.Addr().String(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = lingering.Close()
+	}()
+	echoThrough(t, lingering, "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err = srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected our tunnel to outlast our deadline, got %v", err)
+	}
+	if err = <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected Serve to return ErrServerClosed, got %v", err)
+	}
+	_ = lingering.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = lingering.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected our tunnel to be closed, got %v", err)
+	}
+	if _, err = dialTestHTTP(ln.Addr().String(), target); err == nil {
+		t.Fatal("expected new connections to be refused after shutdown")
+	}
+}
@@ -0,0 +1,96 @@
+package prox5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// splitEndpoint separates the optional "user:pass@" prefix of a proxy endpoint from its address.
+func splitEndpoint(endpoint string) (auth *url.Userinfo, addr string) {
+	at := strings.LastIndex(endpoint, "@")
+	if at < 0 {
+		return nil, endpoint
+	}
+	creds, addr := endpoint[:at], endpoint[at+1:]
+	user, pass, _ := strings.Cut(creds, ":")
+	return url.UserPassword(user, pass), addr
+}
+
+// errUnreachable is wrapped by httpConnect when the proxy tells us it could not reach the address we asked for.
+var errUnreachable = errors.New("http proxy could not reach")
+
+// bufferedConn hands back any bytes the proxy sent after its CONNECT response before reading from the wire again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.r.Read(b)
+}
+
+// httpConnect performs an HTTP CONNECT handshake over conn, asking the proxy to tunnel us to addr.
+// If auth is not nil it is sent as a basic Proxy-Authorization header.
+func httpConnect(conn net.Conn, auth *url.Userinfo, addr string, timeout time.Duration) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth != nil {
+		pass, _ := auth.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(auth.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w %s: %s", errUnreachable, addr, resp.Status)
+	default:
+		_ = conn.Close()
+		return nil, fmt.Errorf("http proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// dialHTTPWithConn returns a dial function that tunnels through an already established connection to an HTTP proxy.
+func dialHTTPWithConn(endpoint string, conn net.Conn, timeout time.Duration) func(network, addr string) (net.Conn, error) {
+	auth, _ := splitEndpoint(endpoint)
+	return func(network, addr string) (net.Conn, error) {
+		return httpConnect(conn, auth, addr, timeout)
+	}
+}
@@ -0,0 +1,256 @@
+package prox5
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type dummyHTTPProxy struct {
+	t        *testing.T
+	user     string
+	pass     string
+	tunnels  *atomic.Int64
+	rejected *atomic.Int64
+	// inject is added to the headers of requests we forward, plain HTTP requests are refused when it is nil.
+	inject http.Header
+	// route, if set, picks where each CONNECT tunnel really goes, e.g. to stand in for a rotating exit.
+	route func(host string) string
+	net.Listener
+}
+
+// forward relays a plain HTTP proxy request, adding our inject headers to it.
+func (dp *dummyHTTPProxy) forward(c net.Conn, req *http.Request) {
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Authorization")
+	for k, v := range dp.inject {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		_, _ = c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	resp.Close = true
+	_ = resp.Write(c)
+}
+
+func (dp *dummyHTTPProxy) handle(c net.Conn) {
+	defer func() {
+		_ = c.Close()
+	}()
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if dp.user != "" {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte(dp.user+":"+dp.pass))
+		if req.Header.Get("Proxy-Authorization") != want {
+			dp.rejected.Add(1)
+			_, _ = c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+	}
+	if req.Method != http.MethodConnect {
+		if dp.inject == nil || !req.URL.IsAbs() {
+			_, _ = c.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+			return
+		}
+		dp.forward(c, req)
+		return
+	}
+	host := req.Host
+	if dp.route != nil {
+		host = dp.route(host)
+	}
+	target, err := net.Dial("tcp", host)
+	if err != nil {
+		_, _ = c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+	if _, err = c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	dp.tunnels.Add(1)
+	go func() {
+		_, _ = io.Copy(target, br)
+	}()
+	_, _ = io.Copy(c, target)
+}
+
+func newDummyHTTPProxy(t *testing.T, user, pass string) *dummyHTTPProxy {
+	t.Helper()
+	dp := &dummyHTTPProxy{t: t, user: user, pass: pass, tunnels: &atomic.Int64{}, rejected: &atomic.Int64{}}
+	var err error
+	if dp.Listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := dp.Accept()
+			if err != nil {
+				return
+			}
+			go dp.handle(c)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = dp.Close()
+	})
+	return dp
+}
+
+// newIPEchoServer stands in for a what-is-my-ip endpoint, answering every request with 127.0.0.1.
+func newIPEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("127.0.0.1"))
+		})); err != nil && !errors.Is(err, net.ErrClosed) {
+			t.Error("[FAIL] http.Serve error: " + err.Error())
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	return "http://" + ln.Addr().String()
+}
+
+func dialTestHTTP(endpoint, target string) (net.Conn, error) {
+	_, proxyAddr := splitEndpoint(endpoint)
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	return dialHTTPWithConn(endpoint, conn, 5*time.Second)("tcp", target)
+}
+
+func TestSplitEndpoint(t *testing.T) {
+	auth, addr := splitEndpoint("user:pass@127.0.0.1:8080")
+	if addr != "127.0.0.1:8080" {
+		t.Errorf("unexpected address: %s", addr)
+	}
+	if auth == nil || auth.Username() != "user" {
+		t.Fatalf("unexpected auth: %v", auth)
+	}
+	if pass, _ := auth.Password(); pass != "pass" {
+		t.Errorf("unexpected password: %s", pass)
+	}
+	if auth, addr = splitEndpoint("127.0.0.1:8080"); auth != nil || addr != "127.0.0.1:8080" {
+		t.Errorf("unexpected result for endpoint without credentials: %v, %s", auth, addr)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	dp := newDummyHTTPProxy(t, "user", "pass")
+	echo := newIPEchoServer(t)
+	target := strings.TrimPrefix(echo, "http://")
+
+	t.Run("authorized", func(t *testing.T) {
+		conn, err := dialTestHTTP("user:pass@"+dp.Addr().String(), target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		req, _ := http.NewRequest(http.MethodGet, echo, nil)
+		if err = req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "127.0.0.1" {
+			t.Errorf("unexpected tunneled response: %s", string(body))
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		_, err := dialTestHTTP("user:wrong@"+dp.Addr().String(), target)
+		if err == nil {
+			t.Fatal("expected error when proxy rejects our credentials")
+		}
+		if dp.rejected.Load() != 1 {
+			t.Errorf("expected one rejected attempt, got %d", dp.rejected.Load())
+		}
+	})
+}
+
+func TestHTTPProxyValidation(t *testing.T) {
+	dp := newDummyHTTPProxy(t, "user", "pass")
+	echo := newIPEchoServer(t)
+
+	p5 := NewProxyEngine()
+	p5.SetAndEnableDebugLogger(p5TestLogger{t: t})
+	p5.SetCheckEndpoints([]string{echo})
+	p5.SetValidationTimeout(2 * time.Second)
+	if !p5.LoadSingleProxy("user:pass@" + dp.Addr().String()) {
+		t.Fatal("failed to load proxy")
+	}
+	if err := p5.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = p5.Close()
+	})
+
+	deadline := time.Now().Add(15 * time.Second)
+	for p5.GetStatistics().ValidHTTP.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("HTTP proxy was never validated")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// stop revalidating so the validator isn't holding our only proxy when we go to dial with it
+	if err := p5.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := p5.GetHTTPClient().Get(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "127.0.0.1" {
+		t.Errorf("unexpected proxied response: %s", string(body))
+	}
+	if dp.tunnels.Load() < 2 {
+		t.Errorf("expected validation and dial to both tunnel through the proxy, got %d tunnels", dp.tunnels.Load())
+	}
+
+	sock, ok := p5.proxyMap.plot.Get("user:pass@" + dp.Addr().String())
+	if !ok {
+		t.Fatal("proxy missing from map")
+	}
+	timings := sock.GetTimings()
+	if timings.Connect <= 0 || timings.Handshake <= 0 || timings.FirstByte <= 0 {
+		t.Errorf("expected all timings to be measured, got %+v", timings)
+	}
+	if hist := sock.GetLatencyHistogram(); hist.Samples < 2 {
+		t.Errorf("expected samples from both validation and dialing, got %d", hist.Samples)
+	}
+}
@@ -0,0 +1,153 @@
+package prox5
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrIntercepted is what we hold against a proxy that presented a certificate other than the one our check endpoint
+// serves, see Intercepting.
+var ErrIntercepted = errors.New("TLS intercepted")
+
+// Fingerprint returns the hex encoded SHA-256 fingerprint of the DER encoding of cert, for use with SetEndpointPins.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// SPKIFingerprint returns the hex encoded SHA-256 fingerprint of the public key of cert, for use with SetEndpointPins.
+// Unlike Fingerprint, it survives the endpoint renewing its certificate with the same key.
+func SPKIFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))
+}
+
+// pinKey is what pins are stored under, the host (and port, if any) of endpoint.
+func pinKey(endpoint string) string {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		return strings.ToLower(u.Host)
+	}
+	return strings.ToLower(endpoint)
+}
+
+// verifyPeer checks the certificates presented to us against roots, the system roots if nil, and against pins if any.
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool, pins []string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no certificate presented", ErrIntercepted)
+	}
+	leaf := cs.PeerCertificates[0]
+	opts := x509.VerifyOptions{Roots: roots, DNSName: cs.ServerName, Intermediates: x509.NewCertPool()}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return fmt.Errorf("%w: %v", ErrIntercepted, err)
+	}
+	if len(pins) == 0 {
+		return nil
+	}
+	leafPrint, spkiPrint := Fingerprint(leaf), SPKIFingerprint(leaf)
+	for _, pin := range pins {
+		if pin == leafPrint || pin == spkiPrint {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: certificate for %s matches none of our pins", ErrIntercepted, cs.ServerName)
+}
+
+// tlsCheck keeps what we made of the certificates presented to us while validating a proxy, see recordInterception.
+type tlsCheck struct {
+	mu *sync.Mutex
+	// checked is set once we've seen a certificate, intercepted holds what was wrong with the first bad one.
+	checked     bool
+	intercepted error
+}
+
+func newTLSCheck() *tlsCheck {
+	return &tlsCheck{mu: &sync.Mutex{}}
+}
+
+func (tc *tlsCheck) record(err error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.checked = true
+	if tc.intercepted == nil {
+		tc.intercepted = err
+	}
+}
+
+func (tc *tlsCheck) result() (checked bool, intercepted error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.checked, tc.intercepted
+}
+
+// validationTLSConfig returns the TLS configuration used for requesting endpoint through a proxy.
+// Certificates are verified by us rather than by crypto/tls so that the request goes through either way, letting us
+// tell a proxy that intercepts TLS apart from one that doesn't work at all. What we make of them goes to tc.
+// They are verified whether or not EnableHTTPClientTLSVerification has been called, see Intercepting.
+func (p5 *ProxyEngine) validationTLSConfig(endpoint string, tc *tlsCheck) *tls.Config {
+	roots, pins := p5.GetValidationRootCAs(), p5.GetEndpointPins(endpoint)
+	return &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			tc.record(verifyPeer(cs, roots, pins))
+			return nil
+		},
+	}
+}
+
+// recordInterception flags sock as Intercepting if tc caught it presenting a substitute certificate,
+// or clears the flag if tc saw it present the genuine one.
+func (p5 *ProxyEngine) recordInterception(sock *Proxy, tc *tlsCheck) {
+	checked, intercepted := tc.result()
+	if !checked {
+		return
+	}
+	if intercepted == nil {
+		sock.intercepting.Store(false)
+		return
+	}
+	p5.flagIntercepting(sock, intercepted)
+}
+
+func (p5 *ProxyEngine) flagIntercepting(sock *Proxy, err error) {
+	if !sock.intercepting.Swap(true) {
+		buf := strs.Get()
+		buf.MustWriteString("proxy intercepts TLS: ")
+		if p5.GetDebugRedactStatus() {
+			buf.MustWriteString("(redacted)")
+		} else {
+			buf.MustWriteString(sock.Endpoint)
+		}
+		buf.MustWriteString(", ")
+		buf.MustWriteString(err.Error())
+		p5.dbgPrint(buf)
+	}
+}
+
+// Intercepting returns whether the proxy was caught presenting a substitute certificate for one of our check
+// endpoints the last time it was validated against an HTTPS endpoint, e.g. to man-in-the-middle our TLS traffic.
+// Certificates are always checked against our root pool, the system roots unless SetValidationRootCAs has been called,
+// and against our pins if any, see SetEndpointPins. Check endpoints serving certificates that don't chain up to our
+// root pool get every proxy flagged, so set a pool that includes their CA. Intercepting proxies aren't dispensed
+// unless EnableInterceptingProxies has been called.
+func (sock *Proxy) Intercepting() bool {
+	return sock.intercepting.Load()
+}
+
+// NotIntercepting is a ProxyFilter that only accepts proxies that have not been caught intercepting TLS.
+func NotIntercepting(sock *Proxy) bool {
+	return !sock.Intercepting()
+}
@@ -0,0 +1,104 @@
+package prox5
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterception(t *testing.T) {
+	site := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.7"))
+	}))
+	defer site.Close()
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetValidationTimeout(2 * time.Second)
+	p5.SetCheckEndpoints([]string{site.URL + "/ip"})
+	p5.DisableRecycling()
+
+	sock, _ := p5.proxyMap.add(upstream.Addr().String())
+	sock.protocol.set(ProtoHTTP)
+
+	genuine := x509.NewCertPool()
+	genuine.AddCert(site.Certificate())
+	fingerprint := Fingerprint(site.Certificate())
+	var colons []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	// TLS verification is left disabled throughout, interception is caught regardless.
+	tests := []struct {
+		name         string
+		roots        *x509.CertPool
+		pins         []string
+		intercepting bool
+	}{
+		{name: "system roots", intercepting: true},
+		{name: "substitute certificate", roots: x509.NewCertPool(), intercepting: true},
+		{name: "genuine certificate", roots: genuine},
+		{name: "wrong pin", roots: genuine, pins: []string{strings.Repeat("ab", 32)}, intercepting: true},
+		{name: "leaf pin", roots: genuine, pins: []string{strings.Join(colons, ":")}},
+		{name: "spki pin", roots: genuine, pins: []string{SPKIFingerprint(site.Certificate())}},
+	}
+	for _, tt := range tests {
+		p5.SetValidationRootCAs(tt.roots)
+		p5.SetEndpointPins(site.URL, tt.pins...)
+		if err := p5.ipEchoCheck(sock, ProtoHTTP); err != nil {
+			t.Fatalf("%s: expected our check to go through either way, got %v", tt.name, err)
+		}
+		if sock.Intercepting() != tt.intercepting {
+			t.Fatalf("%s: expected Intercepting to be %t", tt.name, tt.intercepting)
+		}
+	}
+
+	p5.SetEndpointPins(site.URL, strings.Repeat("ab", 32))
+	if err := p5.ipEchoCheck(sock, ProtoHTTP); err != nil || !sock.Intercepting() {
+		t.Fatalf("expected our proxy to be flagged as intercepting, got %v", err)
+	}
+	sock.good()
+	if !p5.tally(sock) {
+		t.Fatal("failed to tally our proxy")
+	}
+	if _, err := p5.TryGetAnyProxy(); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected intercepting proxies not to be dispensed, got %v", err)
+	}
+	p5.EnableInterceptingProxies()
+	if got, err := p5.TryGetAnyProxy(); err != nil || got != sock {
+		t.Fatalf("expected our intercepting proxy once allowed, got %v (%v)", got, err)
+	}
+
+	t.Run("validators", func(t *testing.T) {
+		p5.SetEndpointPins(site.URL, strings.Repeat("ab", 32))
+		validators := []Validator{IPEchoValidator(site.URL + "/ip")}
+		if err := p5.validatorCheck(sock, ProtoHTTP, validators); err != nil {
+			t.Fatalf("expected our validators to go through either way, got %v", err)
+		}
+		if !sock.Intercepting() {
+			t.Fatal("expected our validators to catch the substitute certificate")
+		}
+
+		p5.SetEndpointPins(site.URL, fingerprint)
+		if err := p5.validatorCheck(sock, ProtoHTTP, validators); err != nil || sock.Intercepting() {
+			t.Fatalf("expected the genuine certificate to clear our flag, got %v", err)
+		}
+
+		p5.SetEndpointPins(site.URL, strings.Repeat("ab", 32))
+		if err := p5.AddValidationProfile(ValidationProfile{Name: "tls", CheckEndpoints: []string{site.URL}}); err != nil {
+			t.Fatal(err)
+		}
+		p5.checkProfiles(sock)
+		if sock.PassesProfile("tls") || !sock.Intercepting() {
+			t.Fatal("expected an intercepted profile check to flag our proxy instead of passing")
+		}
+	})
+}
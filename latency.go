@@ -0,0 +1,158 @@
+package prox5
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWindow is the amount of latency samples we keep per proxy.
+const latencyWindow = 64
+
+// LatencyBuckets are the upper bounds of the buckets used by LatencyHistogram.
+var LatencyBuckets = []time.Duration{
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Timings holds the most recent timing measurements taken for a Proxy, zero values have not been measured.
+type Timings struct {
+	// Connect is how long it took to establish a TCP connection to the proxy.
+	Connect time.Duration
+	// Handshake is how long it took the proxy to connect us to our destination after we were connected to it.
+	Handshake time.Duration
+	// FirstByte is how long it took to receive the first byte of a response after sending our request.
+	// This is only measured during validation.
+	FirstByte time.Duration
+}
+
+// LatencyHistogram is a snapshot of the rolling window of latency samples taken for a Proxy.
+// Each sample is the time it took to connect to the proxy and complete its handshake.
+type LatencyHistogram struct {
+	// Bounds are the upper bounds of each bucket, see LatencyBuckets.
+	Bounds []time.Duration
+	// Counts holds the amount of samples in each bucket, the final entry counts samples that exceed every bound.
+	Counts []int
+	// Samples is the amount of samples currently in the window.
+	Samples int
+	// Mean, P50, and P95 are calculated from the samples currently in the window.
+	Mean time.Duration
+	P50  time.Duration
+	P95  time.Duration
+}
+
+type latencyStats struct {
+	mu      sync.Mutex
+	last    Timings
+	samples [latencyWindow]time.Duration
+	next    int
+	count   int
+}
+
+// recordTimings stores a new set of timings, and adds their sum as a sample to the rolling window.
+func (sock *Proxy) recordTimings(t Timings) {
+	total := t.Connect + t.Handshake
+	ls := &sock.latency
+	ls.mu.Lock()
+	if t.Connect > 0 {
+		ls.last.Connect = t.Connect
+	}
+	if t.Handshake > 0 {
+		ls.last.Handshake = t.Handshake
+	}
+	if t.FirstByte > 0 {
+		ls.last.FirstByte = t.FirstByte
+	}
+	ls.mu.Unlock()
+	sock.recordLatency(total)
+	if sock.parent != nil {
+		sock.parent.metrics.observeTimings(sock.GetProto(), t)
+	}
+}
+
+// recordLatency adds a sample to the rolling window and updates the last known latency.
+func (sock *Proxy) recordLatency(latency time.Duration) {
+	if latency <= 0 {
+		return
+	}
+	atomic.StoreInt64(&sock.lastLatency, int64(latency))
+	ls := &sock.latency
+	ls.mu.Lock()
+	ls.samples[ls.next] = latency
+	ls.next = (ls.next + 1) % latencyWindow
+	if ls.count < latencyWindow {
+		ls.count++
+	}
+	ls.mu.Unlock()
+}
+
+// GetTimings retrieves the most recent timing measurements taken for the Proxy.
+func (sock *Proxy) GetTimings() Timings {
+	sock.latency.mu.Lock()
+	defer sock.latency.mu.Unlock()
+	return sock.latency.last
+}
+
+// GetLatencyHistogram retrieves a snapshot of the rolling window of latency samples taken for the Proxy.
+// Samples are taken during validation, during dials, and from the Outcome of a Lease.
+func (sock *Proxy) GetLatencyHistogram() LatencyHistogram {
+	sock.latency.mu.Lock()
+	samples := make([]time.Duration, sock.latency.count)
+	copy(samples, sock.latency.samples[:sock.latency.count])
+	sock.latency.mu.Unlock()
+
+	hist := LatencyHistogram{
+		Bounds:  LatencyBuckets,
+		Counts:  make([]int, len(LatencyBuckets)+1),
+		Samples: len(samples),
+	}
+	if len(samples) == 0 {
+		return hist
+	}
+
+	var sum time.Duration
+	for _, sample := range samples {
+		sum += sample
+		bucket := sort.Search(len(LatencyBuckets), func(i int) bool {
+			return sample <= LatencyBuckets[i]
+		})
+		hist.Counts[bucket]++
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	hist.Mean = sum / time.Duration(len(samples))
+	hist.P50 = samples[(len(samples)-1)*50/100]
+	hist.P95 = samples[(len(samples)-1)*95/100]
+	return hist
+}
+
+// throughputMinBytes is how much a connection has to transfer before we measure the throughput of its proxy,
+// smaller transfers say more about latency than they do about bandwidth.
+const throughputMinBytes = 32 << 10
+
+// recordThroughput records the throughput of a connection through the proxy that transferred n bytes over elapsed,
+// the time between the first and last bytes going through it.
+func (sock *Proxy) recordThroughput(n int64, elapsed time.Duration) {
+	if n < throughputMinBytes || elapsed <= 0 {
+		return
+	}
+	bps := int64(float64(n) / elapsed.Seconds())
+	atomic.StoreInt64(&sock.throughput, bps)
+	if sock.parent != nil {
+		sock.parent.metrics.throughput.WithLabelValues(sock.GetProto().String()).Observe(float64(bps))
+	}
+}
+
+// GetThroughput retrieves the most recent throughput measured for the Proxy in bytes per second, or zero if none has
+// been measured. Throughput is measured on the connections handed out by our dialers once they are closed, counting
+// the bytes sent and received between the first and last byte. Connections transferring less than 32KiB are ignored.
+func (sock *Proxy) GetThroughput() int64 {
+	return atomic.LoadInt64(&sock.throughput)
+}
@@ -0,0 +1,84 @@
+package prox5
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	sock := &Proxy{Endpoint: "127.0.0.1:1080", protocol: newImmutableProto()}
+	if hist := sock.GetLatencyHistogram(); hist.Samples != 0 || hist.Mean != 0 {
+		t.Fatalf("expected empty histogram, got %+v", hist)
+	}
+
+	sock.recordTimings(Timings{Connect: 10 * time.Millisecond, Handshake: 20 * time.Millisecond})
+	sock.recordTimings(Timings{FirstByte: 40 * time.Millisecond})
+	if timings := sock.GetTimings(); timings.Connect != 10*time.Millisecond ||
+		timings.Handshake != 20*time.Millisecond || timings.FirstByte != 40*time.Millisecond {
+		t.Errorf("unexpected timings: %+v", timings)
+	}
+	if sock.GetLastLatency() != 30*time.Millisecond {
+		t.Errorf("expected last latency of 30ms, got %s", sock.GetLastLatency())
+	}
+
+	for i := 0; i < latencyWindow; i++ {
+		sock.recordLatency(200 * time.Millisecond)
+	}
+	sock.recordLatency(20 * time.Second)
+
+	hist := sock.GetLatencyHistogram()
+	if hist.Samples != latencyWindow {
+		t.Fatalf("expected window to be capped at %d samples, got %d", latencyWindow, hist.Samples)
+	}
+	if hist.Counts[0] != 0 {
+		t.Error("expected oldest sample to have rolled out of the window")
+	}
+	if hist.Counts[2] != latencyWindow-1 || hist.Counts[len(hist.Counts)-1] != 1 {
+		t.Errorf("unexpected bucket counts: %v", hist.Counts)
+	}
+	if hist.P50 != 200*time.Millisecond || hist.P95 != 200*time.Millisecond {
+		t.Errorf("unexpected percentiles: p50 %s, p95 %s", hist.P50, hist.P95)
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	target := newTCPEchoServer(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	sock := addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	transfer := func(size int) {
+		t.Helper()
+		conn, err := p5.DialContext(context.Background(), "tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, _ = conn.Write(bytes.Repeat([]byte("x"), size))
+		}()
+		if _, err = io.ReadFull(conn, make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		p5.enqueue(sock)
+	}
+
+	transfer(1 << 10)
+	if sock.GetThroughput() != 0 {
+		t.Fatalf("expected small transfers to be ignored, got %d", sock.GetThroughput())
+	}
+	transfer(256 << 10)
+	if sock.GetThroughput() <= 0 {
+		t.Fatal("expected our transfer to be measured")
+	}
+}
@@ -0,0 +1,166 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// LeaseResult describes how a leased proxy performed, see Outcome.
+type LeaseResult uint8
+
+const (
+	// LeaseSuccess means the proxy did its job.
+	// It counts towards the proxy's success rate and the proxy is returned to the back of its list.
+	// It does not count as a validation, the proxy still goes stale and gets revalidated as usual.
+	LeaseSuccess LeaseResult = iota
+	// LeaseConnectFailure means we could not connect to or through the proxy itself.
+	// The proxy is marked bad, fed to the bad proxy ratelimiter, and is not returned to the valid lists
+	// until it passes validation again.
+	LeaseConnectFailure
+	// LeaseTargetRefused means the proxy worked, but the target refused the connection.
+	// This is not held against the proxy, it is returned to the back of its list.
+	LeaseTargetRefused
+	// LeaseBanned means the proxy worked, but the target has banned its exit.
+	// The proxy is marked bad (counting towards the removeafter policy) and returned to the back of its list.
+	LeaseBanned
+)
+
+var leaseResultStrings = map[LeaseResult]string{
+	LeaseSuccess:        "success",
+	LeaseConnectFailure: "connect failure",
+	LeaseTargetRefused:  "target refused",
+	LeaseBanned:         "banned",
+}
+
+func (lr LeaseResult) String() string {
+	if s, ok := leaseResultStrings[lr]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// Outcome is the feedback given to ProxyEngine when releasing a Lease.
+type Outcome struct {
+	Result LeaseResult
+	// Latency is the time it took to get a response through the proxy, if known.
+	Latency time.Duration
+}
+
+// ErrLeaseReleased is returned when attempting to release a Lease more than once.
+var ErrLeaseReleased = errors.New("lease already released")
+
+// Lease is a proxy that has been checked out of the pool with ProxyEngine.Acquire.
+// While leased, the proxy will not be dispensed elsewhere or revalidated.
+// A Lease must be released with Release once the caller is done with it.
+type Lease struct {
+	// Proxy is the leased proxy.
+	Proxy *Proxy
+
+	acquired time.Time
+	// exit is the exit IP reserved for this Lease, see EnableDistinctExits.
+	exit     string
+	released *atomic.Bool
+	parent   *ProxyEngine
+}
+
+// Acquired returns the time the Lease was acquired.
+func (l *Lease) Acquired() time.Time {
+	return l.acquired
+}
+
+// Acquire checks a validated proxy that satisfies filter out of the pool.
+// It will block until one is available, ctx is done, or the ProxyEngine is closed (ErrEngineClosed).
+func (p5 *ProxyEngine) Acquire(ctx context.Context, filter ProxyFilter) (lease *Lease, err error) {
+	err = p5.waitFor(ctx, func() error {
+		var tryErr error
+		lease, tryErr = p5.TryAcquire(filter)
+		return tryErr
+	})
+	return lease, err
+}
+
+// TryAcquire is the same as Acquire, but returns ErrNoProxies instead of blocking if no suitable proxy is available.
+func (p5 *ProxyEngine) TryAcquire(filter ProxyFilter) (*Lease, error) {
+	if p5.ctx.Err() != nil {
+		return nil, ErrEngineClosed
+	}
+	distinct := p5.GetDistinctExitsStatus()
+	if distinct {
+		filter = allFilters(p5.exits.leasable, filter)
+	}
+	for {
+		sock := p5.popGood(p5.Valids.Slice(), filter)
+		if sock == nil {
+			p5.recycling()
+			return nil, ErrNoProxies
+		}
+		if !atomic.CompareAndSwapUint32(&sock.lock, stateUnlocked, stateLocked) {
+			// already leased, or being validated (which will put it back in a list when finished)
+			continue
+		}
+		var exit string
+		if distinct {
+			exit = sock.GetExitIP()
+			if !p5.exits.reserve(exit) {
+				// another lease claimed this exit since we checked
+				atomic.StoreUint32(&sock.lock, stateUnlocked)
+				p5.enqueue(sock)
+				continue
+			}
+		}
+		p5.stats.dispense()
+		p5.emit(EventDispensed, sock)
+		return &Lease{
+			Proxy:    sock,
+			acquired: time.Now(),
+			exit:     exit,
+			released: &atomic.Bool{},
+			parent:   p5,
+		}, nil
+	}
+}
+
+// Release returns the leased proxy to the pool, using outcome to adjust its standing. See LeaseResult.
+func (l *Lease) Release(outcome Outcome) error {
+	if _, ok := leaseResultStrings[outcome.Result]; !ok {
+		return fmt.Errorf("unknown lease result: %d", outcome.Result)
+	}
+	if !l.released.CompareAndSwap(false, true) {
+		return ErrLeaseReleased
+	}
+
+	sock := l.Proxy
+	p5 := l.parent
+
+	sock.recordLatency(outcome.Latency)
+
+	putBack := true
+
+	switch outcome.Result {
+	case LeaseSuccess:
+		atomic.AddInt64(&sock.timesSucceeded, 1)
+	case LeaseConnectFailure:
+		sock.bad()
+		p5.badProx.Check(sock)
+		putBack = false
+	case LeaseBanned:
+		sock.bad()
+	case LeaseTargetRefused:
+	}
+
+	atomic.StoreUint32(&sock.lock, stateUnlocked)
+
+	if l.exit != "" {
+		p5.exits.unreserve(l.exit)
+		// wake anyone waiting on a proxy that shares this exit
+		p5.tallied.broadcast()
+	}
+
+	if putBack {
+		p5.enqueue(sock)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	s5 := addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS5)
+	addValidatedProxy(t, p5, "127.0.0.1:8080", ProtoHTTP)
+
+	onlySOCKS5 := func(p *Proxy) bool { return p.GetProto() == ProtoSOCKS5 }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dispensed := p5.Subscribe(EventTypes(EventDispensed))
+	lease, err := p5.Acquire(ctx, onlySOCKS5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Proxy != s5 {
+		t.Fatalf("expected filter to select %s, got %s", s5.Endpoint, lease.Proxy.Endpoint)
+	}
+	if e := nextEvent(t, dispensed); e.Proxy != s5 {
+		t.Errorf("expected a dispensed event for %s, got %v", s5.Endpoint, e.Proxy)
+	}
+	p5.Unsubscribe(dispensed)
+	if p5.Valids.SOCKS5.Len() != 0 {
+		t.Fatal("leased proxy should not remain in the valid list")
+	}
+
+	t.Run("exclusive", func(t *testing.T) {
+		shortCtx, shortCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer shortCancel()
+		if _, err := p5.Acquire(shortCtx, onlySOCKS5); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded while the only match is leased, got %v", err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		validated, lastValidated := atomic.LoadInt64(&s5.timesValidated), s5.lastValidated
+		if err := lease.Release(Outcome{Result: LeaseSuccess, Latency: 150 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt64(&s5.timesSucceeded) != 1 {
+			t.Error("expected success to be counted")
+		}
+		if atomic.LoadInt64(&s5.timesValidated) != validated || !s5.lastValidated.Equal(lastValidated) {
+			t.Error("expected success not to count as a validation")
+		}
+		if s5.GetLastLatency() != 150*time.Millisecond {
+			t.Errorf("expected latency to be recorded, got %s", s5.GetLastLatency())
+		}
+		if p5.Valids.SOCKS5.Len() != 1 {
+			t.Error("expected proxy to be returned to the valid list")
+		}
+		if !errors.Is(lease.Release(Outcome{Result: LeaseSuccess}), ErrLeaseReleased) {
+			t.Error("expected second release to fail")
+		}
+	})
+
+	t.Run("banned", func(t *testing.T) {
+		lease, err := p5.Acquire(ctx, onlySOCKS5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lease.Release(Outcome{Result: LeaseBanned}); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt64(&s5.timesBad) != 1 {
+			t.Errorf("expected banned proxy to be marked bad once, got %d", atomic.LoadInt64(&s5.timesBad))
+		}
+		if p5.Valids.SOCKS5.Len() != 1 {
+			t.Error("expected banned proxy to be returned to the valid list")
+		}
+	})
+
+	t.Run("connect failure", func(t *testing.T) {
+		lease, err := p5.Acquire(ctx, onlySOCKS5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lease.Release(Outcome{Result: LeaseConnectFailure}); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt64(&s5.timesBad) != 2 {
+			t.Errorf("expected proxy to be marked bad twice, got %d", atomic.LoadInt64(&s5.timesBad))
+		}
+		if p5.Valids.SOCKS5.Len() != 0 {
+			t.Error("expected failed proxy to be held out of the valid list until revalidated")
+		}
+	})
+
+	t.Run("unknown result", func(t *testing.T) {
+		lease, err := p5.Acquire(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = lease.Release(Outcome{Result: LeaseResult(255)}); err == nil {
+			t.Fatal("expected error for unknown result")
+		}
+		if err = lease.Release(Outcome{Result: LeaseTargetRefused}); err != nil {
+			t.Fatalf("expected lease to still be releasable, got %v", err)
+		}
+	})
+}
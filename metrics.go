@@ -0,0 +1,192 @@
+package prox5
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons a dial through one of our proxies may fail, used as the reason label of prox5_dial_failures_total.
+const (
+	dialFailProxyConnect = "proxy_connect"
+	dialFailHandshake    = "handshake"
+	dialFailMiddleware   = "middleware"
+	dialFailNoProxies    = "no_proxies"
+	dialFailContext      = "context"
+	dialFailTimeout      = "timeout"
+	dialFailClosed       = "closed"
+)
+
+var autoScalerStates = []string{"disabled", "idle", "scaling up", "scaling down"}
+
+// metrics holds the Prometheus metrics that are updated as things happen,
+// everything else is collected from our Statistics at scrape time. See ProxyEngine.MetricsHandler.
+type metrics struct {
+	registry *prometheus.Registry
+
+	dialAttempts   *prometheus.CounterVec
+	dialFailures   *prometheus.CounterVec
+	bailouts       prometheus.Counter
+	badRateLimited prometheus.Counter
+	latency        *prometheus.HistogramVec
+	throughput     *prometheus.HistogramVec
+}
+
+func newMetrics(p5 *ProxyEngine) *metrics {
+	buckets := make([]float64, len(LatencyBuckets))
+	for i, b := range LatencyBuckets {
+		buckets[i] = b.Seconds()
+	}
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		dialAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "prox5", Name: "dial_attempts_total",
+			Help: "Dials attempted through our proxies, by proxy protocol.",
+		}, []string{"protocol"}),
+		dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "prox5", Name: "dial_failures_total",
+			Help: "Failed dials, by reason.",
+		}, []string{"reason"}),
+		bailouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "prox5", Name: "dial_bailouts_total",
+			Help: "Dials given up on after exceeding the dialer bailout.",
+		}),
+		badRateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "prox5", Name: "bad_ratelimited_total",
+			Help: "Proxies skipped while dispensing because they failed too often recently.",
+		}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "prox5", Name: "latency_seconds",
+			Help:    "Proxy latency by protocol and phase (connect, handshake, first_byte).",
+			Buckets: buckets,
+		}, []string{"protocol", "phase"}),
+		throughput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "prox5", Name: "throughput_bytes_per_second",
+			Help:    "Throughput of the connections handed out by our dialers, by proxy protocol.",
+			Buckets: prometheus.ExponentialBuckets(16<<10, 4, 8),
+		}, []string{"protocol"}),
+	}
+	m.registry.MustRegister(
+		m.dialAttempts, m.dialFailures, m.bailouts, m.badRateLimited, m.latency, m.throughput, engineCollector{p5: p5},
+	)
+	return m
+}
+
+func (m *metrics) dialFailed(reason string) {
+	m.dialFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *metrics) observeTimings(proto ProxyProtocol, t Timings) {
+	for phase, d := range map[string]time.Duration{"connect": t.Connect, "handshake": t.Handshake, "first_byte": t.FirstByte} {
+		if d > 0 {
+			m.latency.WithLabelValues(proto.String(), phase).Observe(d.Seconds())
+		}
+	}
+}
+
+// engineCollector is a prometheus.Collector that reads our Statistics and pool state at scrape time.
+type engineCollector struct {
+	p5 *ProxyEngine
+}
+
+var (
+	validatedDesc = prometheus.NewDesc("prox5_validated_total",
+		"Proxies validated, by protocol.", []string{"protocol"}, nil)
+	validDesc = prometheus.NewDesc("prox5_valid_proxies",
+		"Validated proxies currently waiting to be dispensed, by protocol.", []string{"protocol"}, nil)
+	dispensedDesc = prometheus.NewDesc("prox5_dispensed_total",
+		"Proxies dispensed by our getters.", nil, nil)
+	checkedDesc = prometheus.NewDesc("prox5_checked_total",
+		"Proxy validations attempted.", nil, nil)
+	staleDesc = prometheus.NewDesc("prox5_stale_total",
+		"Proxies skipped while dispensing because they went stale.", nil, nil)
+	knownDesc = prometheus.NewDesc("prox5_known_proxies",
+		"Proxies we have on record.", nil, nil)
+	pendingDesc = prometheus.NewDesc("prox5_pending_proxies",
+		"Proxies waiting to be validated.", nil, nil)
+	badDesc = prometheus.NewDesc("prox5_bad_proxies",
+		"Proxies currently being ratelimited for failing too often.", nil, nil)
+	workersDesc = prometheus.NewDesc("prox5_workers",
+		"Validation worker pool size (max), and how many workers are running and idle.", []string{"state"}, nil)
+	scalerDesc = prometheus.NewDesc("prox5_autoscaler_state",
+		"The current state of the AutoScaler, the active state is 1.", []string{"state"}, nil)
+	uptimeDesc = prometheus.NewDesc("prox5_uptime_seconds",
+		"How long ago this ProxyEngine was created.", nil, nil)
+	endpointResultsDesc = prometheus.NewDesc("prox5_check_endpoint_results",
+		"Recent successes and failures of each of our check endpoints.", []string{"endpoint", "result"}, nil)
+	endpointQuarantinedDesc = prometheus.NewDesc("prox5_check_endpoint_quarantined",
+		"Whether each of our check endpoints is currently quarantined.", []string{"endpoint"}, nil)
+)
+
+func (ec engineCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		validatedDesc, validDesc, dispensedDesc, checkedDesc, staleDesc, knownDesc,
+		pendingDesc, badDesc, workersDesc, scalerDesc, uptimeDesc, endpointResultsDesc, endpointQuarantinedDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (ec engineCollector) Collect(ch chan<- prometheus.Metric) {
+	p5 := ec.p5
+	stats := p5.GetStatistics()
+
+	for proto, count := range map[ProxyProtocol]int64{
+		ProtoSOCKS5: stats.Valid5.Load(), ProtoSOCKS4: stats.Valid4.Load(),
+		ProtoSOCKS4a: stats.Valid4a.Load(), ProtoHTTP: stats.ValidHTTP.Load(),
+	} {
+		ch <- prometheus.MustNewConstMetric(validatedDesc, prometheus.CounterValue, float64(count), proto.String())
+		list := p5.Valids.forProto(proto)
+		list.RLock()
+		ch <- prometheus.MustNewConstMetric(validDesc, prometheus.GaugeValue, float64(list.Len()), proto.String())
+		list.RUnlock()
+	}
+
+	ch <- prometheus.MustNewConstMetric(dispensedDesc, prometheus.CounterValue, float64(stats.Dispensed.Load()))
+	ch <- prometheus.MustNewConstMetric(checkedDesc, prometheus.CounterValue, float64(stats.Checked.Load()))
+	ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.CounterValue, float64(stats.Stale.Load()))
+	ch <- prometheus.MustNewConstMetric(knownDesc, prometheus.GaugeValue, float64(p5.proxyMap.plot.Count()))
+	p5.Pending.RLock()
+	ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(p5.Pending.Len()))
+	p5.Pending.RUnlock()
+	ch <- prometheus.MustNewConstMetric(badDesc, prometheus.GaugeValue, float64(p5.GetTotalBad()))
+
+	maxWorkers, running, idle := p5.GetWorkers()
+	ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue, float64(maxWorkers), "max")
+	ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue, float64(running), "running")
+	ch <- prometheus.MustNewConstMetric(workersDesc, prometheus.GaugeValue, float64(idle), "idle")
+
+	current := p5.GetAutoScalerStateString()
+	for _, state := range autoScalerStates {
+		active := 0.0
+		if state == current {
+			active = 1
+		}
+		ch <- prometheus.MustNewConstMetric(scalerDesc, prometheus.GaugeValue, active, state)
+	}
+
+	ch <- prometheus.MustNewConstMetric(uptimeDesc, prometheus.GaugeValue, stats.GetUptime().Seconds())
+
+	for _, eh := range p5.GetEndpointHealth() {
+		ch <- prometheus.MustNewConstMetric(endpointResultsDesc, prometheus.GaugeValue, float64(eh.Successes), eh.Endpoint, "success")
+		ch <- prometheus.MustNewConstMetric(endpointResultsDesc, prometheus.GaugeValue, float64(eh.Failures), eh.Endpoint, "failure")
+		quarantined := 0.0
+		if eh.Quarantined {
+			quarantined = 1
+		}
+		ch <- prometheus.MustNewConstMetric(endpointQuarantinedDesc, prometheus.GaugeValue, quarantined, eh.Endpoint)
+	}
+}
+
+// MetricsRegistry returns the Prometheus registry holding our metrics, for use with your own exporter.
+func (p5 *ProxyEngine) MetricsRegistry() *prometheus.Registry {
+	return p5.metrics.registry
+}
+
+// MetricsHandler returns an http.Handler that serves our metrics in the Prometheus exposition format.
+// It can be mounted on an existing server, e.g: mux.Handle("/metrics", p5.MetricsHandler()).
+func (p5 *ProxyEngine) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(p5.metrics.registry, promhttp.HandlerOpts{})
+}
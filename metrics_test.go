@@ -0,0 +1,51 @@
+package prox5
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	echo := newIPEchoServer(t)
+	dp := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	addValidatedProxy(t, p5, dp.Addr().String(), ProtoHTTP)
+	addValidatedProxy(t, p5, "127.0.0.1:1", ProtoSOCKS5)
+
+	conn, err := p5.DialContext(context.Background(), "tcp", strings.TrimPrefix(echo, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	rec := httptest.NewRecorder()
+	p5.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	scraped := string(body)
+
+	for _, want := range []string{
+		`prox5_validated_total{protocol="http"} 1`,
+		`prox5_validated_total{protocol="socks5"} 1`,
+		`prox5_dial_attempts_total{protocol="http"} 1`,
+		`prox5_latency_seconds_count{phase="handshake",protocol="http"} 1`,
+		`prox5_autoscaler_state{state="disabled"} 1`,
+		`prox5_workers{state="max"}`,
+		`prox5_known_proxies 2`,
+	} {
+		if !strings.Contains(scraped, want) {
+			t.Errorf("expected scrape to contain %s", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(scraped)
+	}
+}
@@ -1,7 +1,9 @@
 package prox5
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -49,6 +51,16 @@ func (p5 *ProxyEngine) GetHTTPClient() *http.Client {
 	return p5.httpClients.Get().(*http.Client)
 }
 
+// GetSessionHTTPClient retrieves a pointer to an http.Client powered by mysteryDialer that sends all of its
+// requests through the same proxy for as long as the given sticky session lasts. See WithSession.
+func (p5 *ProxyEngine) GetSessionHTTPClient(session string) *http.Client {
+	hc := p5.newHTTPClient().(*http.Client)
+	hc.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p5.DialContext(WithSession(ctx, session), network, addr)
+	}
+	return hc
+}
+
 // RoundTrip is Mr. WorldWide. Obviously. See: https://pkg.go.dev/net/http#RoundTripper
 func (p5 *ProxyEngine) RoundTrip(req *http.Request) (*http.Response, error) {
 	return p5.GetHTTPClient().Do(req)
@@ -2,14 +2,14 @@ package prox5
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync/atomic"
 	"time"
-
-	"git.tcp.direct/kayos/socks"
 )
 
 // DialContext is a simple stub adapter to implement a net.Dialer.
@@ -42,9 +42,7 @@ func (p5 *ProxyEngine) addTimeout(socksString string) string {
 }
 
 func (p5 *ProxyEngine) isEmpty() bool {
-	if p5.GetStatistics().Checked.Load() == 0 {
-		return true
-	}
+	// note: proxies restored with LoadState are valid without having been checked by us.
 	// if stats.Valid5.Load()+stats.Valid4.Load()+stats.Valid4a.Load()+stats.ValidHTTP.Load() == 0 {
 	if p5.GetTotalValidated() == 0 {
 		return true
@@ -59,36 +57,46 @@ func (p5 *ProxyEngine) popSockAndLockIt(ctx context.Context) (*Proxy, error) {
 		p5.scale()
 		return nil, ErrNoProxies
 	}
-	sock := p5.GetAnySOCKS()
-	select {
-	case <-ctx.Done():
-		return nil, fmt.Errorf("context done: %w", ctx.Err())
-	default:
-		//
-	}
-	if sock == nil {
-		return nil, nil
+	sock, err := p5.GetAnyProxyContext(ctx)
+	if err != nil {
+		return nil, err
 	}
 	if atomic.CompareAndSwapUint32(&sock.lock, stateUnlocked, stateLocked) {
 		// p5.msgGotLock(socksString)
 		return sock, nil
 	}
-	switch sock.GetProto() {
-	case ProtoSOCKS5:
-		p5.Valids.SOCKS5.add(sock)
-	case ProtoSOCKS4:
-		p5.Valids.SOCKS4.add(sock)
-	case ProtoSOCKS4a:
-		p5.Valids.SOCKS4a.add(sock)
-	case ProtoHTTP:
-		p5.Valids.HTTP.add(sock)
-	default:
+	if !p5.enqueue(sock) {
 		return nil, fmt.Errorf("unknown protocol: %s", sock.GetProto())
 	}
 
 	return nil, nil
 }
 
+// dialThrough connects to addr through the given proxy, taking note of how long each step took.
+func (p5 *ProxyEngine) dialThrough(sock *Proxy, socksString, network, addr string) (net.Conn, error) {
+	p5.metrics.dialAttempts.WithLabelValues(sock.GetProto().String()).Inc()
+	_, proxyAddr := splitEndpoint(sock.Endpoint)
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", proxyAddr, p5.GetServerTimeout())
+	if err != nil {
+		p5.metrics.dialFailed(dialFailProxyConnect)
+		p5.events.publish(Event{Type: EventDialFailed, Proxy: sock, Target: addr, Err: err})
+		return nil, err
+	}
+	connected := time.Now()
+
+	tunnel, err := p5.handshaker(sock, socksString, conn)(network, addr)
+	if err != nil {
+		p5.metrics.dialFailed(dialFailHandshake)
+		p5.events.publish(Event{Type: EventDialFailed, Proxy: sock, Target: addr, Err: err})
+		_ = conn.Close()
+		return nil, err
+	}
+	sock.recordTimings(Timings{Connect: connected.Sub(start), Handshake: time.Since(connected)})
+	p5.events.publish(Event{Type: EventDialSucceeded, Proxy: sock, Target: addr})
+	return tunnel, nil
+}
+
 func (p5 *ProxyEngine) announceDial(network, addr string) {
 	s := strs.Get()
 	s.MustWriteString("prox5 dialing: ")
@@ -104,16 +112,33 @@ func (p5 *ProxyEngine) announceDial(network, addr string) {
 	p5.dbgPrint(s)
 }
 
-// mysteryDialer is a dialer function that will use a different proxy for every request.
+// mysteryDialer is a dialer function that will use a different proxy for every request,
+// unless ctx carries a sticky session. See WithSession. In chain mode it hands off to chainDialer, see SetChainLength.
 // If you're looking for this function, it has been unexported. Use Dial, DialTimeout, or DialContext instead.
 func (p5 *ProxyEngine) mysteryDialer(ctx context.Context, network, addr string) (net.Conn, error) {
 	p5.announceDial(network, addr)
 
+	if strings.HasPrefix(network, "udp") {
+		return p5.DialUDP(ctx, network, addr)
+	}
+
 	if p5.isEmpty() {
 		// p5.dbgPrint(simpleString("prox5: no proxies available"))
+		p5.metrics.dialFailed(dialFailNoProxies)
 		return nil, ErrNoProxies
 	}
 
+	if p5.chainEnabled() {
+		return p5.chainDialer(ctx, network, addr)
+	}
+
+	session, sticky := SessionFromContext(ctx)
+	if sticky {
+		if conn, ok := p5.dialSession(ctx, session, network, addr); ok {
+			return conn, nil
+		}
+	}
+
 	timeout := time.NewTimer(p5.GetServerTimeout())
 	defer timeout.Stop()
 
@@ -123,18 +148,21 @@ func (p5 *ProxyEngine) mysteryDialer(ctx context.Context, network, addr string)
 		maxBail := p5.GetDialerBailout()
 		switch {
 		case count > maxBail:
+			p5.metrics.bailouts.Inc()
 			return nil, fmt.Errorf("giving up after %d tries", maxBail)
 		case ctx.Err() != nil:
+			p5.metrics.dialFailed(dialFailContext)
 			return nil, fmt.Errorf("context error: %w", ctx.Err())
 		default:
 			select {
 			case <-ctx.Done():
+				p5.metrics.dialFailed(dialFailContext)
 				return nil, fmt.Errorf("context done: %w", ctx.Err())
 			case <-p5.ctx.Done():
+				p5.metrics.dialFailed(dialFailClosed)
 				return nil, fmt.Errorf("prox5 closed: %w", p5.ctx.Err())
-			case <-p5.conKiller:
-				return nil, fmt.Errorf("prox5 closed: %w", io.ErrClosedPipe)
 			case <-timeout.C:
+				p5.metrics.dialFailed(dialFailTimeout)
 				return nil, fmt.Errorf("timeout: %w, %w", io.ErrClosedPipe, os.ErrDeadlineExceeded)
 			default:
 			}
@@ -148,6 +176,14 @@ func (p5 *ProxyEngine) mysteryDialer(ctx context.Context, network, addr string)
 			sock, err = p5.popSockAndLockIt(ctx)
 			if err != nil {
 				// println(err.Error())
+				switch {
+				case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+					p5.metrics.dialFailed(dialFailContext)
+				case errors.Is(err, ErrEngineClosed):
+					p5.metrics.dialFailed(dialFailClosed)
+				default:
+					p5.metrics.dialFailed(dialFailNoProxies)
+				}
 				return nil, err
 			}
 			if sock != nil {
@@ -158,29 +194,22 @@ func (p5 *ProxyEngine) mysteryDialer(ctx context.Context, network, addr string)
 		var ok bool
 		if sock, ok = p5.dispenseMiddleware(sock); !ok {
 			atomic.StoreUint32(&sock.lock, stateUnlocked)
+			p5.metrics.dialFailed(dialFailMiddleware)
 			p5.msgFailedMiddleware(socksString)
 			continue
 		}
 		p5.msgTry(socksString)
 		atomic.StoreUint32(&sock.lock, stateUnlocked)
-		dialSocks := socks.Dial(socksString)
-		conn, err := dialSocks(network, addr)
+		conn, err := p5.dialThrough(sock, socksString, network, addr)
 		if err != nil {
 			count++
 			p5.msgUnableToReach(socksString, addr, err)
 			continue
 		}
 		p5.msgUsingProxy(socksString)
-		go func() {
-			select {
-			case <-ctx.Done():
-				_ = conn.Close()
-			case <-p5.conKiller:
-				_ = conn.Close()
-			case <-p5.ctx.Done():
-				_ = conn.Close()
-			}
-		}()
-		return conn, nil
+		if sticky {
+			p5.sessions.bind(session, sock, p5.GetSessionTTL())
+		}
+		return p5.trackConn(ctx, conn, sock), nil
 	}
 }
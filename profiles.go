@@ -0,0 +1,189 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"git.tcp.direct/kayos/common/entropy"
+)
+
+// ValidationProfile is a named set of checks for one of the targets our proxies are meant for, see AddValidationProfile.
+// A proxy that reaches our check endpoints may well be blocked by the site we actually care about, profiles let us
+// tell those apart and only dispense proxies that pass the profile we ask for, see WithProfile.
+type ValidationProfile struct {
+	Name string
+	// CheckEndpoints are requested through the proxy, one at random per check.
+	// If neither CheckEndpoints nor Validators are set, our own check endpoints are used, see SetCheckEndpoints.
+	CheckEndpoints []string
+	// Status is the status code CheckEndpoints are expected to answer with, 200 if unset.
+	Status int
+	// Match is expected to match the body CheckEndpoints answer with. A nil Match accepts any body.
+	Match *regexp.Regexp
+	// Validators are run on top of CheckEndpoints, see Validator.
+	Validators []Validator
+	// StaleTime is how long a passed check lasts, our own stale time if unset. See SetStaleTime.
+	StaleTime time.Duration
+}
+
+// validator combines the checks of the profile into a single Validator.
+func (vp ValidationProfile) validator(p5 *ProxyEngine) Validator {
+	var validators []Validator
+	if len(vp.CheckEndpoints) > 0 {
+		status := vp.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		endpoints, match := vp.CheckEndpoints, vp.Match
+		validators = append(validators, ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+			return HTTPCheckValidator(entropy.RandomStrChoice(endpoints), status, match).Validate(ctx, dial)
+		}))
+	}
+	validators = append(validators, vp.Validators...)
+	if len(validators) == 0 {
+		validators = append(validators, IPEchoValidator(p5.GetRandomEndpoint()))
+	}
+	return AllOf(validators...)
+}
+
+// AddValidationProfile adds profile to the profiles every proxy is checked against once it passes validation,
+// replacing any profile of the same name. Proxies already in our pool are checked against it the next time they are
+// validated. See WithProfile.
+func (p5 *ProxyEngine) AddValidationProfile(profile ValidationProfile) error {
+	if profile.Name == "" {
+		return errors.New("validation profiles must be named")
+	}
+	p5.opt.Lock()
+	if p5.opt.profiles == nil {
+		p5.opt.profiles = make(map[string]ValidationProfile)
+	}
+	p5.opt.profiles[profile.Name] = profile
+	p5.opt.Unlock()
+	p5.DebugLogger.Printf("prox5 validation profile %s set", profile.Name)
+	return nil
+}
+
+// RemoveValidationProfile removes the profile named name, proxies no longer pass it.
+func (p5 *ProxyEngine) RemoveValidationProfile(name string) {
+	p5.opt.Lock()
+	delete(p5.opt.profiles, name)
+	p5.opt.Unlock()
+	p5.DebugLogger.Printf("prox5 validation profile %s removed", name)
+}
+
+// GetValidationProfile returns the profile named name, see AddValidationProfile.
+func (p5 *ProxyEngine) GetValidationProfile(name string) (ValidationProfile, bool) {
+	p5.opt.RLock()
+	defer p5.opt.RUnlock()
+	profile, ok := p5.opt.profiles[name]
+	return profile, ok
+}
+
+// GetValidationProfiles returns the names of our validation profiles, in order.
+func (p5 *ProxyEngine) GetValidationProfiles() []string {
+	p5.opt.RLock()
+	names := make([]string, 0, len(p5.opt.profiles))
+	for name := range p5.opt.profiles {
+		names = append(names, name)
+	}
+	p5.opt.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// checkProfiles checks sock against each of our validation profiles, recording which ones it passes.
+// Failing a profile does not count against the proxy, it just won't be dispensed for that profile.
+func (p5 *ProxyEngine) checkProfiles(sock *Proxy) {
+	names := p5.GetValidationProfiles()
+	if len(names) == 0 {
+		return
+	}
+	passed := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		profile, ok := p5.GetValidationProfile(name)
+		if !ok {
+			continue
+		}
+		var timings Timings
+		dial := p5.candidateDialer(sock, sock.GetProto(), &timings)
+		tc := newTLSCheck()
+		ctx, cancel := context.WithTimeout(p5.ctx, p5.GetValidationTimeout())
+		verdict := profile.validator(p5).Validate(p5.validatorContext(ctx, tc), dial)
+		cancel()
+		// nothing a proxy intercepting our TLS showed us counts, and it is an intercepting proxy all the same.
+		if _, intercepted := tc.result(); intercepted != nil {
+			p5.flagIntercepting(sock, intercepted)
+			continue
+		}
+		if verdict.OK {
+			passed[name] = time.Now()
+		}
+	}
+	sock.profiles.Store(&passed)
+}
+
+// PassesProfile returns whether the proxy passed the validation profile named name, and the pass is not yet stale.
+func (sock *Proxy) PassesProfile(name string) bool {
+	passed := sock.profiles.Load()
+	if passed == nil || sock.parent == nil {
+		return false
+	}
+	at, ok := (*passed)[name]
+	if !ok {
+		return false
+	}
+	profile, ok := sock.parent.GetValidationProfile(name)
+	if !ok {
+		return false
+	}
+	stale := profile.StaleTime
+	if stale <= 0 {
+		stale = sock.parent.GetStaleTime()
+	}
+	return time.Since(at) <= stale
+}
+
+// GetProfiles returns the names of the validation profiles the proxy currently passes, in order.
+func (sock *Proxy) GetProfiles() []string {
+	passed := sock.profiles.Load()
+	if passed == nil {
+		return nil
+	}
+	var names []string
+	for name := range *passed {
+		if sock.PassesProfile(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InProfiles returns a ProxyFilter that only accepts proxies currently passing every one of the named validation profiles.
+func InProfiles(names ...string) ProxyFilter {
+	return func(sock *Proxy) bool {
+		for _, name := range names {
+			if !sock.PassesProfile(name) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// WithProfile returns a copy of ctx that makes our context aware getters and dialers only dispense proxies currently
+// passing the validation profile named name, e.g. p5.DialContext(WithProfile(ctx, "shop"), "tcp", addr).
+func WithProfile(ctx context.Context, name string) context.Context {
+	return WithFilter(ctx, InProfiles(name))
+}
+
+// profileFilter returns a ProxyFilter for the given profile names, or nil if there are none.
+func profileFilter(profiles []string) ProxyFilter {
+	if len(profiles) == 0 {
+		return nil
+	}
+	return InProfiles(profiles...)
+}
@@ -0,0 +1,91 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestValidationProfiles(t *testing.T) {
+	site := newValidatorSite(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	_ = ln.Close()
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetValidationTimeout(2 * time.Second)
+	p5.DisableRecycling()
+
+	if err = p5.AddValidationProfile(ValidationProfile{}); err == nil {
+		t.Fatal("expected an unnamed profile to be refused")
+	}
+	for _, profile := range []ValidationProfile{
+		{Name: "shop", CheckEndpoints: []string{site.URL + "/shop"}, Match: regexp.MustCompile("Real Shop")},
+		{Name: "fake", CheckEndpoints: []string{site.URL + "/shop"}, Match: regexp.MustCompile("Fake")},
+	} {
+		if err = p5.AddValidationProfile(profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := p5.GetValidationProfiles(); !reflect.DeepEqual(got, []string{"fake", "shop"}) {
+		t.Fatalf("unexpected profiles: %v", got)
+	}
+
+	good := addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	dead := addValidatedProxy(t, p5, deadAddr, ProtoHTTP)
+	p5.checkProfiles(good)
+	p5.checkProfiles(dead)
+	if got := good.GetProfiles(); !reflect.DeepEqual(got, []string{"shop"}) {
+		t.Fatalf("expected our proxy to pass only the shop profile, got %v", got)
+	}
+	if got := dead.GetProfiles(); len(got) != 0 {
+		t.Fatalf("expected our dead proxy to pass no profiles, got %v", got)
+	}
+
+	if _, err = p5.TryGetAnyProxy("fake"); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected no proxies to pass the fake profile, got %v", err)
+	}
+	sock, err := p5.TryGetAnyProxy("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sock != good {
+		t.Fatalf("expected %s, got %s", good.Endpoint, sock.Endpoint)
+	}
+	if _, err = p5.TryGetAnyProxy("shop"); !errors.Is(err, ErrNoProxies) {
+		t.Fatalf("expected our dead proxy not to be dispensed for the shop profile, got %v", err)
+	}
+	p5.enqueue(good)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if sock, err = p5.GetAnyProxyContext(WithProfile(ctx, "shop")); err != nil || sock != good {
+		t.Fatalf("expected WithProfile to dispense %s, got %v (%v)", good.Endpoint, sock, err)
+	}
+	p5.enqueue(good)
+
+	shop, _ := p5.GetValidationProfile("shop")
+	shop.StaleTime = time.Nanosecond
+	if err = p5.AddValidationProfile(shop); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if good.PassesProfile("shop") {
+		t.Fatal("expected a stale pass not to count")
+	}
+	p5.RemoveValidationProfile("fake")
+	if got := p5.GetValidationProfiles(); !reflect.DeepEqual(got, []string{"shop"}) {
+		t.Fatalf("unexpected profiles after removal: %v", got)
+	}
+}
@@ -1,6 +1,7 @@
 package prox5
 
 import (
+	"sync/atomic"
 	"time"
 
 	rl "github.com/yunginnanet/Rate5"
@@ -29,14 +30,40 @@ type Proxy struct {
 	// ProxiedIP is the address that we end up having when making proxied requests through this proxy
 	// TODO: parse this and store as flat int type
 	ProxiedIP string
-	// protocol is the version/Protocol (currently SOCKS* only) of the proxy
+	// protocol is the version/Protocol (SOCKS4/4a/5 or HTTP) of the proxy, either probed for or pinned by a URI scheme
 	protocol proto
 	// lastValidated is the time this proxy was last verified working
 	lastValidated time.Time
 	// timesValidated is the amount of times the proxy has been validated.
 	timesValidated int64
+	// timesSucceeded is the amount of times a Lease on the proxy was released with LeaseSuccess.
+	timesSucceeded int64
 	// timesBad is the amount of times the proxy has been marked as bad.
 	timesBad int64
+	// throughput is the most recent throughput measured for this proxy, in bytes per second. See GetThroughput.
+	throughput int64
+	// lastLatency is the most recent latency measured for this proxy, in nanoseconds.
+	lastLatency int64
+	// lastUsed is the last time this proxy was dispensed, in unix nanoseconds.
+	lastUsed int64
+	// latency holds our timing measurements and rolling latency window for this proxy.
+	latency latencyStats
+	// anonymity is the AnonymityLevel this proxy was last judged to have.
+	anonymity uint32
+	// exitChanges is the amount of times this proxy was seen exiting through a different IP than the time before.
+	exitChanges int64
+	// geo is what our GeoIP databases know about ProxiedIP, see SetGeoIPDatabase.
+	geo atomic.Pointer[GeoInfo]
+	// udp is whether this proxy relays UDP for us, if known. See GetUDPSupport.
+	udp uint32
+	// validation is what our validators recorded about this proxy, see GetValidationMetadata.
+	validation atomic.Pointer[map[string]string]
+	// profiles is when this proxy last passed each of our validation profiles, see PassesProfile.
+	profiles atomic.Pointer[map[string]time.Time]
+	// untrusted is set once this proxy has been caught tampering with our checks, see IsUntrusted.
+	untrusted atomic.Bool
+	// intercepting is set when this proxy presented a substitute certificate for one of our check endpoints, see Intercepting.
+	intercepting atomic.Bool
 
 	parent *ProxyEngine
 	lock   uint32
@@ -53,6 +80,28 @@ func (sock *Proxy) GetProto() ProxyProtocol {
 	return sock.protocol.Get()
 }
 
+// GetLastLatency retrieves the most recent latency reported for the Proxy, or zero if none has been reported.
+func (sock *Proxy) GetLastLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sock.lastLatency))
+}
+
+// GetLastUsed retrieves the last time the Proxy was dispensed, or the zero time if it never has been.
+func (sock *Proxy) GetLastUsed() time.Time {
+	used := atomic.LoadInt64(&sock.lastUsed)
+	if used == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, used)
+}
+
+// GetSuccessRate retrieves the ratio of successful validations and leases versus times the Proxy has been marked bad.
+// The ratio is smoothed so that proxies without much history land close to 0.5 rather than at either extreme.
+func (sock *Proxy) GetSuccessRate() float64 {
+	good := float64(atomic.LoadInt64(&sock.timesValidated) + atomic.LoadInt64(&sock.timesSucceeded))
+	bad := float64(atomic.LoadInt64(&sock.timesBad))
+	return (good + 1) / (good + bad + 2)
+}
+
 // GetProto safely retrieves the protocol value of the Proxy.
 func (sock *Proxy) String() string {
 	buf := strs.Get()
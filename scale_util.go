@@ -56,6 +56,7 @@ func (p5 *ProxyEngine) scale() (sleep bool) {
 			totalConsidered,
 		) {
 			p5.scaleDbg()
+			p5.events.publish(Event{Type: EventScaled, Workers: p5.pool.Cap()})
 		}
 	default:
 		return
@@ -0,0 +1,150 @@
+package prox5
+
+import (
+	"math"
+	"sync"
+
+	"git.tcp.direct/kayos/common/entropy"
+)
+
+// Selector decides which of the currently available proxies gets dispensed next.
+// Implementations must be safe for concurrent use. See ProxyEngine.SetSelector.
+type Selector interface {
+	// Select returns the index of the chosen proxy within candidates, which is never empty.
+	// Select is called while our valid lists are locked, so it must not call back into ProxyEngine.
+	Select(candidates []*Proxy) int
+}
+
+// SelectorFunc is an adapter to allow the use of ordinary functions as a Selector.
+type SelectorFunc func(candidates []*Proxy) int
+
+// Select calls f(candidates).
+func (f SelectorFunc) Select(candidates []*Proxy) int {
+	return f(candidates)
+}
+
+type roundRobinSelector struct {
+	last string
+	mu   *sync.Mutex
+}
+
+// NewRoundRobinSelector returns a Selector that walks through the available proxies in a stable order,
+// picking up where it left off even as proxies come and go.
+func NewRoundRobinSelector() Selector {
+	return &roundRobinSelector{mu: &sync.Mutex{}}
+}
+
+// Select picks the candidate with the smallest endpoint greater than the last one picked, wrapping around to the
+// smallest endpoint overall. This is a single pass over candidates, Select runs while our valid lists are locked.
+func (rr *roundRobinSelector) Select(candidates []*Proxy) int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	next, first := -1, 0
+	for i, sock := range candidates {
+		if sock.Endpoint < candidates[first].Endpoint {
+			first = i
+		}
+		if sock.Endpoint > rr.last && (next < 0 || sock.Endpoint < candidates[next].Endpoint) {
+			next = i
+		}
+	}
+	if next < 0 {
+		next = first
+	}
+	rr.last = candidates[next].Endpoint
+	return next
+}
+
+type lowestLatencySelector struct{}
+
+// NewLowestLatencySelector returns a Selector that picks the proxy with the lowest measured latency.
+// Proxies that have not been measured yet are only chosen when no measured proxies are available.
+func NewLowestLatencySelector() Selector {
+	return lowestLatencySelector{}
+}
+
+func (lowestLatencySelector) Select(candidates []*Proxy) int {
+	chosen := 0
+	best := int64(math.MaxInt64)
+	for i, sock := range candidates {
+		latency := int64(sock.GetLastLatency())
+		if latency > 0 && latency < best {
+			best = latency
+			chosen = i
+		}
+	}
+	return chosen
+}
+
+type leastRecentlyUsedSelector struct{}
+
+// NewLeastRecentlyUsedSelector returns a Selector that picks the proxy that was dispensed the longest time ago.
+func NewLeastRecentlyUsedSelector() Selector {
+	return leastRecentlyUsedSelector{}
+}
+
+func (leastRecentlyUsedSelector) Select(candidates []*Proxy) int {
+	chosen := 0
+	for i, sock := range candidates {
+		if sock.GetLastUsed().Before(candidates[chosen].GetLastUsed()) {
+			chosen = i
+		}
+	}
+	return chosen
+}
+
+type weightedRandomSelector struct{}
+
+// NewWeightedRandomSelector returns a Selector that picks proxies at random, weighted by their success rate.
+func NewWeightedRandomSelector() Selector {
+	return weightedRandomSelector{}
+}
+
+func (weightedRandomSelector) Select(candidates []*Proxy) int {
+	var total float64
+	weights := make([]float64, len(candidates))
+	for i, sock := range candidates {
+		weights[i] = sock.GetSuccessRate()
+		total += weights[i]
+	}
+	pick := entropy.GetOptimizedRand().Float64() * total
+	for i, w := range weights {
+		if pick < w {
+			return i
+		}
+		pick -= w
+	}
+	return len(candidates) - 1
+}
+
+type powerOfTwoSelector struct{}
+
+// NewPowerOfTwoSelector returns a Selector that draws two proxies at random and keeps the better of the two.
+// The better proxy is the one with the higher success rate, with ties going to the lower latency.
+func NewPowerOfTwoSelector() Selector {
+	return powerOfTwoSelector{}
+}
+
+func (powerOfTwoSelector) Select(candidates []*Proxy) int {
+	if len(candidates) == 1 {
+		return 0
+	}
+	rng := entropy.GetOptimizedRand()
+	a := rng.Intn(len(candidates))
+	b := rng.Intn(len(candidates) - 1)
+	if b >= a {
+		b++
+	}
+	rateA, rateB := candidates[a].GetSuccessRate(), candidates[b].GetSuccessRate()
+	latA, latB := candidates[a].GetLastLatency(), candidates[b].GetLastLatency()
+	switch {
+	case rateA > rateB:
+		return a
+	case rateB > rateA:
+		return b
+	case latB > 0 && (latA == 0 || latB < latA):
+		return b
+	default:
+		return a
+	}
+}
@@ -0,0 +1,108 @@
+package prox5
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func testCandidates() []*Proxy {
+	mk := func(endpoint string, latency time.Duration, used int64, good, bad int64) *Proxy {
+		return &Proxy{
+			Endpoint:       endpoint,
+			protocol:       newImmutableProto(),
+			lastLatency:    int64(latency),
+			lastUsed:       used,
+			timesValidated: good,
+			timesBad:       bad,
+		}
+	}
+	return []*Proxy{
+		mk("127.0.0.3:1080", 300*time.Millisecond, 30, 10, 0),
+		mk("127.0.0.1:1080", 0, 10, 0, 10),
+		mk("127.0.0.2:1080", 50*time.Millisecond, 20, 5, 5),
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	sel := NewRoundRobinSelector()
+	candidates := testCandidates()
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, candidates[sel.Select(candidates)].Endpoint)
+	}
+	want := []string{"127.0.0.1:1080", "127.0.0.2:1080", "127.0.0.3:1080", "127.0.0.1:1080"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("unexpected round robin order: got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestLowestLatencySelector(t *testing.T) {
+	candidates := testCandidates()
+	if got := candidates[NewLowestLatencySelector().Select(candidates)].Endpoint; got != "127.0.0.2:1080" {
+		t.Errorf("expected the fastest measured proxy, got %s", got)
+	}
+}
+
+func TestLeastRecentlyUsedSelector(t *testing.T) {
+	candidates := testCandidates()
+	if got := candidates[NewLeastRecentlyUsedSelector().Select(candidates)].Endpoint; got != "127.0.0.1:1080" {
+		t.Errorf("expected the least recently used proxy, got %s", got)
+	}
+}
+
+func TestWeightedRandomSelector(t *testing.T) {
+	sel := NewWeightedRandomSelector()
+	candidates := testCandidates()
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[candidates[sel.Select(candidates)].Endpoint]++
+	}
+	if counts["127.0.0.3:1080"] <= counts["127.0.0.1:1080"] {
+		t.Errorf("expected the reliable proxy to be chosen more often than the unreliable one: %v", counts)
+	}
+}
+
+func TestPowerOfTwoSelector(t *testing.T) {
+	sel := NewPowerOfTwoSelector()
+	candidates := testCandidates()
+	for i := 0; i < 100; i++ {
+		if got := candidates[sel.Select(candidates)].Endpoint; got == "127.0.0.1:1080" {
+			t.Fatal("the worst proxy should always lose its draw")
+		}
+	}
+	if sel.Select(candidates[:1]) != 0 {
+		t.Error("expected the only candidate to be chosen")
+	}
+}
+
+func TestSetSelector(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	slow := addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS5)
+	fast := addValidatedProxy(t, p5, "127.0.0.2:1080", ProtoSOCKS4)
+	slow.lastLatency = int64(time.Second)
+	fast.lastLatency = int64(time.Millisecond)
+
+	p5.SetSelector(NewLowestLatencySelector())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sock, err := p5.GetAnyProxyContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sock != fast {
+		t.Errorf("expected selector to choose %s, got %s", fast.Endpoint, sock.Endpoint)
+	}
+	if sock.GetLastUsed().IsZero() {
+		t.Error("expected dispensed proxy to have its last used time set")
+	}
+	if p5.Valids.SOCKS4.Len() != 0 || p5.Valids.SOCKS5.Len() != 1 {
+		t.Error("expected only the selected proxy to be removed from the valid lists")
+	}
+}
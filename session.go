@@ -0,0 +1,157 @@
+package prox5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"git.tcp.direct/kayos/go-socks5"
+)
+
+// defaultSessionTTL is how long a sticky session keeps its proxy unless changed with SetSessionTTL.
+var defaultSessionTTL = 10 * time.Minute
+
+type sessionCtxKey struct{}
+
+// WithSession returns a copy of ctx that makes our dialers reuse the same proxy for every dial made with the given session ID.
+// The session keeps its proxy until a dial through it fails or the session TTL expires, at which point the session
+// transparently moves on to a new proxy. See SetSessionTTL.
+func WithSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionCtxKey{}, id)
+}
+
+// SessionFromContext retrieves the session ID carried by ctx, if any. See WithSession.
+func SessionFromContext(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(sessionCtxKey{}).(string)
+	return id, ok && id != ""
+}
+
+type stickySession struct {
+	sock    *Proxy
+	expires time.Time
+}
+
+// sessionTable binds session IDs to the proxy they are stuck to.
+type sessionTable struct {
+	sessions  map[string]stickySession
+	lastSweep time.Time
+	mu        *sync.Mutex
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[string]stickySession), lastSweep: time.Now(), mu: &sync.Mutex{}}
+}
+
+// get returns the proxy bound to the session, or nil if there is none or it has expired.
+func (st *sessionTable) get(id string) *Proxy {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(st.sessions, id)
+		return nil
+	}
+	return s.sock
+}
+
+// bind sticks the session to sock for ttl, sweeping out expired sessions every so often.
+func (st *sessionTable) bind(id string, sock *Proxy, ttl time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.sessions[id] = stickySession{sock: sock, expires: now.Add(ttl)}
+	if now.Sub(st.lastSweep) < time.Minute {
+		return
+	}
+	for k, s := range st.sessions {
+		if now.After(s.expires) {
+			delete(st.sessions, k)
+		}
+	}
+	st.lastSweep = now
+}
+
+// drop ends the session, but only if it is still bound to sock. A nil sock ends the session regardless.
+func (st *sessionTable) drop(id string, sock *Proxy) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s, ok := st.sessions[id]; ok && (sock == nil || s.sock == sock) {
+		delete(st.sessions, id)
+	}
+}
+
+func (st *sessionTable) len() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return len(st.sessions)
+}
+
+// EndSession releases the proxy held by a sticky session, the next dial with that session ID will get a new one.
+func (p5 *ProxyEngine) EndSession(id string) {
+	p5.sessions.drop(id, nil)
+}
+
+// sessionUsable reports whether a proxy held by a session is still fit to be used.
+// Unlike stillGood, this leaves the proxy and its lock alone, as sessions don't take proxies out of our valid lists.
+func (p5 *ProxyEngine) sessionUsable(sock *Proxy, filter ProxyFilter) bool {
+	if _, ok := p5.proxyMap.plot.Get(sock.Endpoint); !ok {
+		return false
+	}
+	if filter = p5.engineFilter(filter); filter != nil && !filter(sock) {
+		return false
+	}
+	if p5.badProx.Peek(sock) {
+		return false
+	}
+	return time.Since(sock.lastValidated) <= p5.GetStaleTime()
+}
+
+// dialSession attempts to dial through the proxy held by the session, ending the session if that isn't possible.
+func (p5 *ProxyEngine) dialSession(ctx context.Context, id, network, addr string) (net.Conn, bool) {
+	sock := p5.sessions.get(id)
+	if sock == nil {
+		return nil, false
+	}
+	if !p5.sessionUsable(sock, FilterFromContext(ctx)) {
+		p5.sessions.drop(id, sock)
+		return nil, false
+	}
+	socksString := sock.String()
+	p5.msgTry(socksString)
+	conn, err := p5.dialThrough(sock, socksString, network, addr)
+	if err != nil {
+		p5.msgUnableToReach(socksString, addr, err)
+		p5.sessions.drop(id, sock)
+		return nil, false
+	}
+	p5.msgUsingProxy(socksString)
+	return p5.trackConn(ctx, conn, sock), true
+}
+
+// clientSession gives a client of one of our servers a sticky session keyed by its address, if server sticky sessions are enabled.
+func (p5 *ProxyEngine) clientSession(ctx context.Context, remoteAddr string) context.Context {
+	if _, ok := SessionFromContext(ctx); ok || !p5.GetServerStickySessionStatus() {
+		return ctx
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return ctx
+	}
+	return WithSession(ctx, "client:"+host)
+}
+
+// sessionRule is a go-socks5 RuleSet that gives each client of our SOCKS5 server a sticky session, see clientSession.
+type sessionRule struct {
+	p5 *ProxyEngine
+}
+
+func (sr sessionRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr == nil {
+		return ctx, true
+	}
+	return sr.p5.clientSession(ctx, req.RemoteAddr.String()), true
+}
@@ -0,0 +1,96 @@
+package prox5
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	st := newSessionTable()
+	a, b := &Proxy{Endpoint: "127.0.0.1:1080"}, &Proxy{Endpoint: "127.0.0.2:1080"}
+
+	st.bind("alice", a, time.Minute)
+	st.bind("bob", b, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if st.get("alice") != a {
+		t.Error("expected alice to be stuck to her proxy")
+	}
+	if st.get("bob") != nil {
+		t.Error("expected bob's session to have expired")
+	}
+	st.drop("alice", b)
+	if st.get("alice") != a {
+		t.Error("dropping a session bound to another proxy should leave it alone")
+	}
+	st.drop("alice", a)
+	if st.get("alice") != nil || st.len() != 0 {
+		t.Error("expected every session to be gone")
+	}
+}
+
+func TestStickySessions(t *testing.T) {
+	echo := newIPEchoServer(t)
+	target := strings.TrimPrefix(echo, "http://")
+	first, second := newDummyHTTPProxy(t, "", ""), newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetAndEnableDebugLogger(p5TestLogger{t: t})
+	p5.SetServerTimeout(2 * time.Second)
+	addValidatedProxy(t, p5, first.Addr().String(), ProtoHTTP)
+	addValidatedProxy(t, p5, second.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	ctx := WithSession(context.Background(), "checkout")
+	dial := func() {
+		t.Helper()
+		conn, err := p5.DialContext(ctx, "tcp", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+
+	for i := 0; i < 3; i++ {
+		dial()
+	}
+	used, spare := first, second
+	if second.tunnels.Load() > 0 {
+		used, spare = second, first
+	}
+	if used.tunnels.Load() != 3 || spare.tunnels.Load() != 0 {
+		t.Fatalf("expected every dial to go through one proxy, got %d and %d",
+			used.tunnels.Load(), spare.tunnels.Load())
+	}
+
+	// our proxy goes away, the session should move on without the caller noticing
+	_ = used.Close()
+	dial()
+	dial()
+	if spare.tunnels.Load() != 2 {
+		t.Fatalf("expected the session to fail over and stick to the spare proxy, got %d", spare.tunnels.Load())
+	}
+
+	resp, err := p5.GetSessionHTTPClient("checkout").Get(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if spare.tunnels.Load() != 3 {
+		t.Errorf("expected the session HTTP client to use the session's proxy, got %d", spare.tunnels.Load())
+	}
+
+	p5.EndSession("checkout")
+	short, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err = p5.DialContext(short, "tcp", target); err == nil {
+		t.Error("expected the ended session to need a fresh proxy, and our pool to be out of them")
+	}
+}
@@ -1,9 +1,17 @@
 package prox5
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"git.tcp.direct/kayos/go-socks5"
+	"git.tcp.direct/kayos/go-socks5/statute"
 
 	"git.tcp.direct/kayos/common/pool"
 )
@@ -14,10 +22,11 @@ type cpool struct {
 	*sync.Pool
 }
 
+// bufs hands out empty buffers with room to grow, as go-socks5 expects. Use buf[:cap(buf)] to read into one.
 var bufs = cpool{
 	Pool: &sync.Pool{
 		New: func() interface{} {
-			return make([]byte, 32*1024)
+			return make([]byte, 0, 32*1024)
 		},
 	},
 }
@@ -27,29 +36,388 @@ func (c cpool) Get() []byte {
 }
 
 func (c cpool) Put(cc []byte) {
-	c.Pool.Put(cc)
+	c.Pool.Put(cc[:0]) //nolint:staticcheck
 }
 
-// StartSOCKS5Server starts our rotating proxy SOCKS5 server.
-// listen is standard Go listen string, e.g: "127.0.0.1:1080".
-// username and password are used for authenticatig to the SOCKS5 server.
-func (p5 *ProxyEngine) StartSOCKS5Server(listen, username, password string) error {
+// ErrServerClosed is returned by SOCKS5Server.Serve and HTTPProxyServer.Serve once the server has been shut down or closed.
+var ErrServerClosed = errors.New("prox5: server closed")
+
+// SOCKS5Server is our rotating proxy SOCKS5 server, see NewSOCKS5Server.
+type SOCKS5Server struct {
+	p5     *ProxyEngine
+	server *socks5.Server
+
+	listeners map[net.Listener]struct{}
+	// clients are keyed by remote address, which is how go-socks5 tells us who a request belongs to.
+	clients map[string]*serverConn
+	nextID  uint64
+	closing bool
+	mu      *sync.Mutex
+}
+
+// ServerSession describes a client connection to our SOCKS5 server, see SOCKS5Server.Sessions.
+type ServerSession struct {
+	ID     uint64
+	Client string
+	// User is the name the client authenticated as through our UserStore, if any. See SetUserStore.
+	User string
+	// Target is the destination the client asked for, it is empty until the client's request has been read.
+	Target  string
+	Started time.Time
+	// BytesIn were received from the client, BytesOut were sent to it.
+	BytesIn  int64
+	BytesOut int64
+}
+
+// serverConn is a client connection to our SOCKS5 server that counts the bytes going through it.
+type serverConn struct {
+	net.Conn
+	id      uint64
+	started time.Time
+	target  *atomic.Value
+	in      *atomic.Int64
+	out     *atomic.Int64
+
+	// auth is set once the client authenticates, admitted once its request counts towards its user's connections.
+	auth     *atomic.Pointer[serverAuth]
+	admitted *atomic.Bool
+
+	// cancel ends the context of the client's request, which closes the connection we dialed for it.
+	cancel context.CancelFunc
+	closed bool
+	mu     *sync.Mutex
+}
+
+// bind ties the context of the client's request to this connection, see Close.
+func (sc *serverConn) bind(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.closed {
+		cancel()
+		return ctx
+	}
+	sc.cancel = cancel
+	return ctx
+}
+
+// Close closes the client connection along with anything we dialed on its behalf.
+func (sc *serverConn) Close() error {
+	sc.mu.Lock()
+	sc.closed = true
+	if sc.cancel != nil {
+		sc.cancel()
+	}
+	sc.mu.Unlock()
+	return sc.Conn.Close()
+}
+
+// grant returns the user the client authenticated as through our UserStore, if any.
+func (sc *serverConn) grant() *userGrant {
+	if auth := sc.auth.Load(); auth != nil {
+		return auth.grant
+	}
+	return nil
+}
+
+func (sc *serverConn) Read(b []byte) (int, error) {
+	n, err := sc.Conn.Read(b)
+	sc.in.Add(int64(n))
+	if g := sc.grant(); g != nil {
+		if qerr := g.count(n, 0); qerr != nil && err == nil {
+			err = qerr
+		}
+	}
+	return n, err
+}
+
+func (sc *serverConn) Write(b []byte) (int, error) {
+	g := sc.grant()
+	if g != nil && g.overQuota() {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := sc.Conn.Write(b)
+	sc.out.Add(int64(n))
+	if g != nil {
+		_ = g.count(0, n)
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection when it supports it, go-socks5 relies on this when proxying.
+func (sc *serverConn) CloseWrite() error {
+	if cw, ok := sc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (sc *serverConn) session() ServerSession {
+	target, _ := sc.target.Load().(string)
+	var user string
+	if auth := sc.auth.Load(); auth != nil {
+		user = auth.base
+	}
+	return ServerSession{
+		ID:       sc.id,
+		Client:   sc.RemoteAddr().String(),
+		User:     user,
+		Target:   target,
+		Started:  sc.started,
+		BytesIn:  sc.in.Load(),
+		BytesOut: sc.out.Load(),
+	}
+}
+
+func (srv *SOCKS5Server) client(remoteAddr string) (*serverConn, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	sc, ok := srv.clients[remoteAddr]
+	return sc, ok
+}
+
+// serverCredentials authenticates clients of our SOCKS5 server, see authenticateClient.
+type serverCredentials struct {
+	srv      *SOCKS5Server
+	username string
+	password string
+}
+
+func (creds serverCredentials) Valid(username, password, userAddr string) bool {
+	auth, ok := creds.srv.p5.authenticateClient(username, password, creds.username, creds.password)
+	if !ok {
+		return false
+	}
+	if sc, ok := creds.srv.client(userAddr); ok {
+		sc.auth.Store(auth)
+	}
+	return true
+}
+
+// requestTarget is the destination of a request as the client asked for it, before any local name resolution.
+func requestTarget(addr *statute.AddrSpec) string {
+	if addr.FQDN != "" {
+		return net.JoinHostPort(addr.FQDN, strconv.Itoa(addr.Port))
+	}
+	return addr.String()
+}
+
+// serverRule records the target of each request on its serverConn, ties the request to it, and applies the
+// policy and username parameters of the client before handing off to sessionRule.
+type serverRule struct {
+	srv *SOCKS5Server
+}
+
+func (sr serverRule) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr == nil || req.DestAddr == nil {
+		return sessionRule{p5: sr.srv.p5}.Allow(ctx, req)
+	}
+	sc, ok := sr.srv.client(req.RemoteAddr.String())
+	if !ok {
+		return sessionRule{p5: sr.srv.p5}.Allow(ctx, req)
+	}
+	target := requestTarget(req.DestAddr)
+	sc.target.Store(target)
+	ctx = sc.bind(ctx)
+	if auth := sc.auth.Load(); auth != nil {
+		if auth.grant != nil {
+			if err := auth.grant.admit(target); err != nil {
+				sr.srv.p5.DebugLogger.Printf("prox5 SOCKS5 server: %s to %s: %v", auth.base, target, err)
+				return ctx, false
+			}
+			sc.admitted.Store(true)
+		}
+		ctx = auth.context(ctx)
+	}
+	return sessionRule{p5: sr.srv.p5}.Allow(ctx, req)
+}
+
+// NewSOCKS5Server returns a handle to our rotating proxy SOCKS5 server, see Serve, Shutdown, and Sessions.
+// username and password are used for authenticatig to the SOCKS5 server, leave either empty to disable it.
+// If a UserStore is set when the server is created, its users may authenticate too and are held to their policy.
+// See SetUserStore.
+func (p5 *ProxyEngine) NewSOCKS5Server(username, password string) *SOCKS5Server {
+	srv := &SOCKS5Server{
+		p5:        p5,
+		listeners: make(map[net.Listener]struct{}),
+		clients:   make(map[string]*serverConn),
+		mu:        &sync.Mutex{},
+	}
 	opts := []socks5.Option{
 		socks5.WithBufferPool(bufs),
 		socks5.WithLogger(p5.DebugLogger),
 		socks5.WithDial(p5.DialContext),
+		socks5.WithRule(serverRule{srv: srv}),
 	}
-	if username != "" && password != "" {
-		cator := socks5.UserPassAuthenticator{Credentials: socks5.StaticCredentials{username: password}}
+	if (username != "" && password != "") || p5.GetUserStore() != nil {
+		creds := serverCredentials{srv: srv, username: username, password: password}
+		cator := socks5.UserPassAuthenticator{Credentials: creds}
 		opts = append(opts, socks5.WithAuthMethods([]socks5.Authenticator{cator}))
 	}
+	srv.server = socks5.NewServer(opts...)
+	return srv
+}
+
+// Serve accepts connections on l until it fails or the server is shut down, in which case ErrServerClosed is returned.
+// Serve closes l when it returns.
+func (srv *SOCKS5Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[l] = struct{}{}
+	srv.mu.Unlock()
 
-	server := socks5.NewServer(opts...)
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, l)
+		srv.mu.Unlock()
+		_ = l.Close()
+	}()
 
 	buf := strs.Get()
 	buf.MustWriteString("listening for SOCKS5 connections on ")
-	buf.MustWriteString(listen)
-	p5.dbgPrint(buf)
+	buf.MustWriteString(l.Addr().String())
+	srv.p5.dbgPrint(buf)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			closing := srv.closing
+			srv.mu.Unlock()
+			if closing {
+				return ErrServerClosed
+			}
+			return err
+		}
+		sc, ok := srv.track(conn)
+		if !ok {
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer srv.untrack(sc)
+			if err := srv.server.ServeConn(sc); err != nil {
+				srv.p5.DebugLogger.Printf("prox5 SOCKS5 server: %v", err)
+			}
+		}()
+	}
+}
+
+// ListenAndServe listens on the standard Go listen string listen, e.g: "127.0.0.1:1080", then calls Serve.
+func (srv *SOCKS5Server) ListenAndServe(listen string) error {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(l)
+}
+
+func (srv *SOCKS5Server) track(conn net.Conn) (*serverConn, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return nil, false
+	}
+	srv.nextID++
+	sc := &serverConn{
+		Conn:     conn,
+		id:       srv.nextID,
+		started:  time.Now(),
+		target:   &atomic.Value{},
+		in:       &atomic.Int64{},
+		out:      &atomic.Int64{},
+		auth:     &atomic.Pointer[serverAuth]{},
+		admitted: &atomic.Bool{},
+		mu:       &sync.Mutex{},
+	}
+	srv.clients[conn.RemoteAddr().String()] = sc
+	return sc, true
+}
+
+func (srv *SOCKS5Server) untrack(sc *serverConn) {
+	srv.mu.Lock()
+	if srv.clients[sc.RemoteAddr().String()] == sc {
+		delete(srv.clients, sc.RemoteAddr().String())
+	}
+	srv.mu.Unlock()
+	if g := sc.grant(); g != nil && sc.admitted.Load() {
+		g.release()
+	}
+}
+
+// Sessions returns the client connections currently being served, along with the bytes moved through each so far.
+func (srv *SOCKS5Server) Sessions() []ServerSession {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	sessions := make([]ServerSession, 0, len(srv.clients))
+	for _, sc := range srv.clients {
+		sessions = append(sessions, sc.session())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
 
-	return server.ListenAndServe("tcp", listen)
+// stopListening marks the server as closing and closes its listeners, new connections are refused from here on.
+func (srv *SOCKS5Server) stopListening() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.closing = true
+	for l := range srv.listeners {
+		_ = l.Close()
+	}
+}
+
+func (srv *SOCKS5Server) active() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.clients)
+}
+
+// closeClients closes every client connection currently being served.
+func (srv *SOCKS5Server) closeClients() {
+	srv.mu.Lock()
+	clients := make([]*serverConn, 0, len(srv.clients))
+	for _, sc := range srv.clients {
+		clients = append(clients, sc)
+	}
+	srv.mu.Unlock()
+	for _, sc := range clients {
+		_ = sc.Close()
+	}
+}
+
+// Shutdown stops accepting new connections and waits for active ones to finish.
+// If ctx is done first, the remaining connections are closed and the context's error is returned.
+func (srv *SOCKS5Server) Shutdown(ctx context.Context) error {
+	srv.stopListening()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for srv.active() > 0 {
+		select {
+		case <-ctx.Done():
+			srv.closeClients()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Close stops accepting new connections and closes all active ones immediately.
+func (srv *SOCKS5Server) Close() error {
+	srv.stopListening()
+	srv.closeClients()
+	return nil
+}
+
+// StartSOCKS5Server starts our rotating proxy SOCKS5 server and blocks until it fails.
+// listen is standard Go listen string, e.g: "127.0.0.1:1080".
+// username and password are used for authenticatig to the SOCKS5 server.
+// See NewSOCKS5Server for a server that can be stopped.
+func (p5 *ProxyEngine) StartSOCKS5Server(listen, username, password string) error {
+	return p5.NewSOCKS5Server(username, password).ListenAndServe(listen)
 }
@@ -0,0 +1,206 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTCPEchoServer echoes back whatever its clients send.
+func newTCPEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	return ln.Addr().String()
+}
+
+// dialTestSOCKS5 connects to target through the SOCKS5 server at proxyAddr, authenticating with auth ("user:pass") if set.
+func dialTestSOCKS5(proxyAddr, auth, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	conn, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := []byte{5, 1, 0}
+	if auth != "" {
+		user, pass, _ := strings.Cut(auth, ":")
+		req = []byte{5, 1, 2, 1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+	}
+	req = append(req, 5, 1, 0, 1)
+	req = append(req, net.ParseIP(host).To4()...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp := make([]byte, 2)
+	if auth != "" {
+		resp = make([]byte, 4)
+	}
+	if _, err = io.ReadFull(conn, resp); err != nil || resp[len(resp)-1] != 0 {
+		_ = conn.Close()
+		return nil, fmt.Errorf("SOCKS5 authentication failed: %v", err)
+	}
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if reply[1] != 0 {
+		_ = conn.Close()
+		return nil, errors.New("SOCKS5 request failed with reply " + strconv.Itoa(int(reply[1])))
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func echoThrough(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("unexpected echo %q", buf)
+	}
+}
+
+func TestSOCKS5Server(t *testing.T) {
+	target := newTCPEchoServer(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	sock := addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := p5.NewSOCKS5Server("", "")
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	lingering, err := dialTestSOCKS5(ln.Addr().String(), "", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = lingering.Close()
+	}()
+	echoThrough(t, lingering, "hello")
+
+	sessions := srv.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected 1 active session, got %d", len(sessions))
+	}
+	if sessions[0].Target != target || sessions[0].Client != lingering.LocalAddr().String() {
+		t.Errorf("unexpected session: %+v", sessions[0])
+	}
+	// the SOCKS5 handshake is counted too.
+	if sessions[0].BytesIn < int64(len("hello")) || sessions[0].BytesOut < int64(len("hello")) {
+		t.Errorf("expected our byte counters to cover the echo, got %d in and %d out",
+			sessions[0].BytesIn, sessions[0].BytesOut)
+	}
+
+	p5.enqueue(sock)
+	brief, err := dialTestSOCKS5(ln.Addr().String(), "", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, brief, "bye")
+	_ = brief.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err = srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lingering connection to outlast our deadline, got %v", err)
+	}
+	if err = <-served; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected Serve to return ErrServerClosed, got %v", err)
+	}
+	_ = lingering.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = lingering.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the lingering connection to be closed, got %v", err)
+	}
+	if _, err = dialTestSOCKS5(ln.Addr().String(), "", target); err == nil {
+		t.Fatal("expected new connections to be refused after shutdown")
+	}
+	if err = srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expected a drained server to shut down cleanly, got %v", err)
+	}
+}
+
+func TestCloseAllConns(t *testing.T) {
+	target := newTCPEchoServer(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	conn, err := p5.DialContext(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoThrough(t, conn, "hello")
+	if p5.conns.len() != 1 {
+		t.Fatalf("expected 1 tracked connection, got %d", p5.conns.len())
+	}
+
+	p5.CloseAllConns()
+	if _, err = conn.Write([]byte("hello")); err == nil {
+		t.Fatal("expected our connection to be closed")
+	}
+	if p5.conns.len() != 0 {
+		t.Fatalf("expected no tracked connections, got %d", p5.conns.len())
+	}
+}
@@ -0,0 +1,169 @@
+package prox5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// stateVersion is the version of the format written by SaveState, bump it whenever savedProxy changes.
+// Version 2 added Untrusted and Intercepting, LoadState still reads version 1.
+const stateVersion = 2
+
+type savedState struct {
+	Version int          `json:"version"`
+	Saved   time.Time    `json:"saved"`
+	Proxies []savedProxy `json:"proxies"`
+}
+
+type savedProxy struct {
+	Endpoint       string         `json:"endpoint"`
+	Protocol       string         `json:"protocol"`
+	ProxiedIP      string         `json:"proxied_ip,omitempty"`
+	LastValidated  time.Time      `json:"last_validated"`
+	TimesValidated int64          `json:"times_validated"`
+	TimesBad       int64          `json:"times_bad"`
+	LastLatency    time.Duration  `json:"last_latency,omitempty"`
+	Anonymity      AnonymityLevel `json:"anonymity,omitempty"`
+	UDP            string         `json:"udp,omitempty"`
+	Untrusted      bool           `json:"untrusted,omitempty"`
+	Intercepting   bool           `json:"intercepting,omitempty"`
+}
+
+func protoFromString(s string) ProxyProtocol {
+	for p, name := range protoMap {
+		if name == s {
+			return p
+		}
+	}
+	return ProtoNull
+}
+
+// SaveState writes every proxy we have on record, along with its history, to w.
+// The output can be fed to LoadState to pick up where we left off after a restart.
+func (p5 *ProxyEngine) SaveState(w io.Writer) error {
+	state := savedState{Version: stateVersion, Saved: time.Now()}
+	for tuple := range p5.proxyMap.plot.IterBuffered() {
+		sock := tuple.Val
+		state.Proxies = append(state.Proxies, savedProxy{
+			Endpoint:       sock.Endpoint,
+			Protocol:       sock.GetProto().String(),
+			ProxiedIP:      sock.GetExitIP(),
+			LastValidated:  sock.lastValidated,
+			TimesValidated: atomic.LoadInt64(&sock.timesValidated),
+			TimesBad:       atomic.LoadInt64(&sock.timesBad),
+			LastLatency:    sock.GetLastLatency(),
+			Anonymity:      sock.GetAnonymity(),
+			UDP:            udpStrings[atomic.LoadUint32(&sock.udp)],
+			Untrusted:      sock.IsUntrusted(),
+			Intercepting:   sock.Intercepting(),
+		})
+	}
+	return json.NewEncoder(w).Encode(state)
+}
+
+// LoadState restores proxies and their history previously written by SaveState, returning how many were restored.
+// Proxies we already have on record are skipped. Restored proxies that were valid and have not gone stale
+// are placed straight into our valid lists, the rest are queued for validation like any freshly loaded proxy.
+func (p5 *ProxyEngine) LoadState(r io.Reader) (count int, err error) {
+	var state savedState
+	if err = json.NewDecoder(r).Decode(&state); err != nil {
+		return 0, fmt.Errorf("failed to decode prox5 state: %w", err)
+	}
+	if state.Version < 1 || state.Version > stateVersion {
+		return 0, fmt.Errorf("unsupported prox5 state version %d, expected %d", state.Version, stateVersion)
+	}
+
+	stale := p5.GetStaleTime()
+	for _, saved := range state.Proxies {
+		if saved.Endpoint == "" {
+			continue
+		}
+		if _, exists := p5.proxyMap.plot.Get(saved.Endpoint); exists {
+			continue
+		}
+		sock, _ := p5.proxyMap.add(saved.Endpoint)
+		if proto := protoFromString(saved.Protocol); proto != ProtoNull {
+			sock.protocol.set(proto)
+		}
+		p5.exits.record(sock, saved.ProxiedIP)
+		p5.enrichGeo(sock)
+		sock.lastValidated = saved.LastValidated
+		atomic.StoreInt64(&sock.timesValidated, saved.TimesValidated)
+		atomic.StoreInt64(&sock.timesBad, saved.TimesBad)
+		atomic.StoreInt64(&sock.lastLatency, int64(saved.LastLatency))
+		atomic.StoreUint32(&sock.anonymity, uint32(saved.Anonymity))
+		atomic.StoreUint32(&sock.udp, udpFromString(saved.UDP))
+		sock.untrusted.Store(saved.Untrusted)
+		sock.intercepting.Store(saved.Intercepting)
+		count++
+		p5.emit(EventLoaded, sock)
+
+		// untrusted proxies fail validation without being checked, let them do so rather than listing them.
+		if !saved.Untrusted && saved.TimesValidated > 0 && time.Since(saved.LastValidated) <= stale && p5.tally(sock) {
+			continue
+		}
+		p5.Pending.add(sock)
+	}
+
+	buf := strs.Get()
+	buf.MustWriteString("restored ")
+	buf.MustWriteString(strconv.Itoa(count))
+	buf.MustWriteString(" proxies from saved state")
+	p5.dbgPrint(buf)
+	return count, nil
+}
+
+// SaveStateFile is SaveState for a file at path. The file is replaced atomically, so a crash mid-save leaves the old one intact.
+func (p5 *ProxyEngine) SaveStateFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err = p5.SaveState(tmp); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadStateFile is LoadState for a file at path.
+func (p5 *ProxyEngine) LoadStateFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return p5.LoadState(f)
+}
+
+// autosave writes our state to path every interval until ctx is done or the ProxyEngine is closed.
+func (p5 *ProxyEngine) autosave(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p5.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p5.SaveStateFile(path); err != nil {
+				p5.dbgPrint(simpleString("autosave failed: " + err.Error()))
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package prox5
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadState(t *testing.T) {
+	src := NewProxyEngine()
+	defer func() {
+		_ = src.Close()
+	}()
+	good := addValidatedProxy(t, src, "127.0.0.1:1080", ProtoSOCKS5)
+	good.ProxiedIP = "192.0.2.1"
+	good.timesBad = 2
+	good.lastLatency = int64(150 * time.Millisecond)
+	stale := addValidatedProxy(t, src, "127.0.0.2:8080", ProtoHTTP)
+	stale.lastValidated = time.Now().Add(-2 * time.Hour)
+	untrusted := addValidatedProxy(t, src, "127.0.0.4:1080", ProtoSOCKS4)
+	untrusted.untrusted.Store(true)
+	intercepting := addValidatedProxy(t, src, "127.0.0.5:8080", ProtoHTTP)
+	intercepting.intercepting.Store(true)
+	if !src.LoadSingleProxy("127.0.0.3:1080") {
+		t.Fatal("failed to load proxy")
+	}
+
+	var saved bytes.Buffer
+	if err := src.SaveState(&saved); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewProxyEngine()
+	defer func() {
+		_ = dst.Close()
+	}()
+	count, err := dst.LoadState(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("expected 5 restored proxies, got %d", count)
+	}
+	if dst.Valids.SOCKS5.Len() != 1 || dst.Valids.SOCKS4.Len() != 0 || dst.Valids.HTTP.Len() != 1 || dst.Pending.Len() != 3 {
+		t.Errorf("expected only the fresh trusted proxies to skip validation, got %d valid SOCKS5, %d valid SOCKS4, "+
+			"%d valid HTTP, %d pending", dst.Valids.SOCKS5.Len(), dst.Valids.SOCKS4.Len(), dst.Valids.HTTP.Len(), dst.Pending.Len())
+	}
+	for endpoint, flagged := range map[string]func(*Proxy) bool{
+		"127.0.0.4:1080": (*Proxy).IsUntrusted,
+		"127.0.0.5:8080": (*Proxy).Intercepting,
+	} {
+		if sock, ok := dst.proxyMap.plot.Get(endpoint); !ok || !flagged(sock) {
+			t.Errorf("expected %s to keep its flag", endpoint)
+		}
+	}
+
+	restored, ok := dst.proxyMap.plot.Get("127.0.0.1:1080")
+	if !ok {
+		t.Fatal("expected our good proxy to be restored")
+	}
+	if restored.GetProto() != ProtoSOCKS5 || restored.ProxiedIP != "192.0.2.1" || restored.timesValidated != 1 ||
+		restored.timesBad != 2 || restored.GetLastLatency() != 150*time.Millisecond {
+		t.Errorf("proxy history was not restored: %+v", restored)
+	}
+	if sock, err := dst.TrySocks5Str(); err != nil || sock != "127.0.0.1:1080" {
+		t.Errorf("expected the restored proxy to be dispensable right away, got %q: %v", sock, err)
+	}
+
+	if count, _ = dst.LoadState(bytes.NewReader(saved.Bytes())); count != 0 {
+		t.Errorf("expected proxies we already have to be skipped, restored %d", count)
+	}
+
+	if _, err = dst.LoadState(strings.NewReader(`{"version": 1, "proxies": []}`)); err != nil {
+		t.Errorf("expected version 1 state to still load, got %v", err)
+	}
+	if _, err = dst.LoadState(strings.NewReader(`{"version": 9001, "proxies": []}`)); err == nil {
+		t.Error("expected an error for an unsupported state version")
+	}
+}
+
+func TestAutoSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prox5.json")
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	addValidatedProxy(t, p5, "127.0.0.1:1080", ProtoSOCKS4)
+	p5.SetAutoSave(path, 10*time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("state was never autosaved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	p5.SetAutoSave("", 0)
+
+	restored := NewProxyEngine()
+	defer func() {
+		_ = restored.Close()
+	}()
+	if count, err := restored.LoadStateFile(path); err != nil || count != 1 {
+		t.Fatalf("expected to restore our proxy from the autosave, got %d: %v", count, err)
+	}
+}
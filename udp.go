@@ -0,0 +1,355 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.tcp.direct/kayos/go-socks5/statute"
+	"github.com/miekg/dns"
+)
+
+// ErrUDPNotSupported is returned when a proxy refuses to relay UDP for us.
+var ErrUDPNotSupported = errors.New("proxy does not support UDP ASSOCIATE")
+
+// defaultUDPProbeTarget is the DNS server our UDP probe queries unless changed with SetUDPProbeTarget.
+const defaultUDPProbeTarget = "1.1.1.1:53"
+
+const (
+	udpUnknown uint32 = iota
+	udpSupported
+	udpUnsupported
+)
+
+var udpStrings = map[uint32]string{
+	udpSupported:   "supported",
+	udpUnsupported: "unsupported",
+}
+
+func udpFromString(s string) uint32 {
+	for state, name := range udpStrings {
+		if name == s {
+			return state
+		}
+	}
+	return udpUnknown
+}
+
+// GetUDPSupport reports whether the Proxy relays UDP for us. known is false until the Proxy has been probed during
+// validation (see ProxyEngine.EnableUDPProbe) or used by ProxyEngine.ListenPacket.
+func (sock *Proxy) GetUDPSupport() (supported, known bool) {
+	state := atomic.LoadUint32(&sock.udp)
+	return state == udpSupported, state != udpUnknown
+}
+
+// udpCapable accepts SOCKS5 proxies that have not been found to be unable to relay UDP.
+func udpCapable(sock *Proxy) bool {
+	return sock.GetProto() == ProtoSOCKS5 && atomic.LoadUint32(&sock.udp) != udpUnsupported
+}
+
+// udpAssociate performs a SOCKS5 UDP ASSOCIATE handshake over conn, returning the relay our datagrams should be sent to.
+// The association lasts for as long as conn stays open.
+func udpAssociate(conn net.Conn, auth *url.Userinfo, timeout time.Duration) (*net.UDPAddr, error) {
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer func() {
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	methods := []byte{statute.MethodNoAuth}
+	if auth != nil {
+		methods = append(methods, statute.MethodUserPassAuth)
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, methods).Bytes()); err != nil {
+		return nil, err
+	}
+	method, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch method.Method {
+	case statute.MethodNoAuth:
+	case statute.MethodUserPassAuth:
+		if auth == nil {
+			return nil, errors.New("proxy requires authentication")
+		}
+		pass, _ := auth.Password()
+		req := statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(auth.Username()), []byte(pass))
+		if _, err = conn.Write(req.Bytes()); err != nil {
+			return nil, err
+		}
+		status, err := statute.ParseUserPassReply(conn)
+		if err != nil {
+			return nil, err
+		}
+		if status.Status != statute.AuthSuccess {
+			return nil, errors.New("proxy rejected our credentials")
+		}
+	default:
+		return nil, statute.ErrNotSupportMethod
+	}
+
+	req := statute.Request{
+		Version: statute.VersionSocks5,
+		Command: statute.CommandAssociate,
+		DstAddr: statute.AddrSpec{IP: net.IPv4zero, AddrType: statute.ATYPIPv4},
+	}
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return nil, err
+	}
+	rep, err := statute.ParseReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Response != statute.RepSuccess {
+		return nil, fmt.Errorf("%w: reply code %d", ErrUDPNotSupported, rep.Response)
+	}
+
+	relay := &net.UDPAddr{IP: rep.BndAddr.IP, Port: rep.BndAddr.Port}
+	if rep.BndAddr.FQDN != "" {
+		if relay, err = net.ResolveUDPAddr("udp", rep.BndAddr.String()); err != nil {
+			return nil, err
+		}
+	}
+	// many servers answer with an unspecified address, meaning "the address you reached me on".
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			relay.IP = tcpAddr.IP
+		}
+	}
+	return relay, nil
+}
+
+// udpHostAddr is the address of a datagram's peer as given to or reported by the proxy, which may be a hostname.
+type udpHostAddr string
+
+func (a udpHostAddr) Network() string {
+	return "udp"
+}
+
+func (a udpHostAddr) String() string {
+	return string(a)
+}
+
+// socksPacketConn is a net.PacketConn that relays datagrams through a SOCKS5 proxy.
+type socksPacketConn struct {
+	conn      *net.UDPConn
+	relay     *net.UDPAddr
+	ctrl      net.Conn
+	closeOnce *sync.Once
+}
+
+func newSocksPacketConn(conn *net.UDPConn, relay *net.UDPAddr, ctrl net.Conn) *socksPacketConn {
+	spc := &socksPacketConn{conn: conn, relay: relay, ctrl: ctrl, closeOnce: &sync.Once{}}
+	// the proxy ends the association by closing our control connection, so should we.
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := ctrl.Read(buf); err != nil {
+				_ = spc.Close()
+				return
+			}
+		}
+	}()
+	return spc
+}
+
+func (spc *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := bufs.Get()
+	defer bufs.Put(buf)
+	buf = buf[:cap(buf)]
+	for {
+		n, from, err := spc.conn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(spc.relay.IP) || from.Port != spc.relay.Port {
+			continue
+		}
+		dg, err := statute.ParseDatagram(buf[:n])
+		if err != nil || dg.Frag != 0 {
+			// we don't do fragmentation, nor does anyone else.
+			continue
+		}
+		var addr net.Addr = udpHostAddr(dg.DstAddr.String())
+		if dg.DstAddr.FQDN == "" {
+			addr = &net.UDPAddr{IP: dg.DstAddr.IP, Port: dg.DstAddr.Port}
+		}
+		return copy(b, dg.Data), addr, nil
+	}
+}
+
+func (spc *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	dg, err := statute.NewDatagram(addr.String(), b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = spc.conn.WriteToUDP(dg.Bytes(), spc.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (spc *socksPacketConn) Close() error {
+	var err error
+	spc.closeOnce.Do(func() {
+		err = spc.conn.Close()
+		_ = spc.ctrl.Close()
+	})
+	return err
+}
+
+func (spc *socksPacketConn) LocalAddr() net.Addr {
+	return spc.conn.LocalAddr()
+}
+
+func (spc *socksPacketConn) SetDeadline(t time.Time) error {
+	return spc.conn.SetDeadline(t)
+}
+
+func (spc *socksPacketConn) SetReadDeadline(t time.Time) error {
+	return spc.conn.SetReadDeadline(t)
+}
+
+func (spc *socksPacketConn) SetWriteDeadline(t time.Time) error {
+	return spc.conn.SetWriteDeadline(t)
+}
+
+// socksUDPConn is a socksPacketConn tied to a single peer, so that it can be used as a net.Conn.
+type socksUDPConn struct {
+	*socksPacketConn
+	remote net.Addr
+}
+
+func (suc *socksUDPConn) Read(b []byte) (int, error) {
+	n, _, err := suc.ReadFrom(b)
+	return n, err
+}
+
+func (suc *socksUDPConn) Write(b []byte) (int, error) {
+	return suc.WriteTo(b, suc.remote)
+}
+
+func (suc *socksUDPConn) RemoteAddr() net.Addr {
+	return suc.remote
+}
+
+// associateThrough asks sock to relay UDP for us, recording whether it was willing to.
+// timeout bounds both connecting to sock and the handshake.
+func (p5 *ProxyEngine) associateThrough(sock *Proxy, timeout time.Duration) (*socksPacketConn, error) {
+	auth, proxyAddr := splitEndpoint(sock.Endpoint)
+	ctrl, err := net.DialTimeout("tcp", proxyAddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	relay, err := udpAssociate(ctrl, auth, timeout)
+	if err != nil {
+		_ = ctrl.Close()
+		if errors.Is(err, ErrUDPNotSupported) {
+			atomic.StoreUint32(&sock.udp, udpUnsupported)
+		}
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		_ = ctrl.Close()
+		return nil, err
+	}
+	atomic.StoreUint32(&sock.udp, udpSupported)
+	return newSocksPacketConn(conn, relay, ctrl), nil
+}
+
+// ListenPacket returns a net.PacketConn that relays datagrams through a SOCKS5 proxy from our pool using UDP ASSOCIATE.
+// Proxies known to refuse UDP are skipped. If ctx carries a sticky session (see WithSession) bound to a SOCKS5 proxy,
+// that proxy is used. ctx only governs finding a proxy, the returned connection lives until it is closed.
+func (p5 *ProxyEngine) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return p5.listenPacket(ctx)
+}
+
+func (p5 *ProxyEngine) listenPacket(ctx context.Context) (*socksPacketConn, error) {
+	if p5.isEmpty() {
+		return nil, ErrNoProxies
+	}
+
+	session, sticky := SessionFromContext(ctx)
+	if sticky {
+		if sock := p5.sessions.get(session); sock != nil && udpCapable(sock) && p5.sessionUsable(sock, FilterFromContext(ctx)) {
+			if pc, err := p5.associateThrough(sock, p5.GetServerTimeout()); err == nil {
+				return pc, nil
+			}
+			p5.sessions.drop(session, sock)
+		}
+	}
+
+	ctx = WithFilter(ctx, udpCapable)
+	socks5Only := func() []*proxyList { return []*proxyList{&p5.Valids.SOCKS5} }
+	var lastErr error
+	for count := 0; count <= p5.GetDialerBailout(); count++ {
+		sock, err := p5.dispenseContext(ctx, socks5Only)
+		if err != nil {
+			return nil, err
+		}
+		pc, err := p5.associateThrough(sock, p5.GetServerTimeout())
+		if err == nil {
+			p5.msgUsingProxy(sock.String())
+			if sticky {
+				p5.sessions.bind(session, sock, p5.GetSessionTTL())
+			}
+			return pc, nil
+		}
+		lastErr = err
+		p5.msgUnableToReach(sock.String(), "udp associate", err)
+		if errors.Is(err, ErrUDPNotSupported) {
+			// it still works for TCP.
+			p5.enqueue(sock)
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d tries: %w", p5.GetDialerBailout(), lastErr)
+}
+
+// DialUDP returns a connection to addr that relays datagrams through a SOCKS5 proxy from our pool, see ListenPacket.
+// Unlike with ListenPacket, the returned connection is tied to ctx: it is closed when ctx is done, same as the
+// connections returned by DialContext. It is also closed when the ProxyEngine is.
+// Our dialers hand udp networks off to DialUDP, which is also how our SOCKS5 server relays UDP ASSOCIATE requests.
+func (p5 *ProxyEngine) DialUDP(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !strings.HasPrefix(network, "udp") {
+		return nil, fmt.Errorf("unsupported network for DialUDP: %s", network)
+	}
+	pc, err := p5.listenPacket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p5.trackConn(ctx, &socksUDPConn{socksPacketConn: pc, remote: udpHostAddr(addr)}, nil), nil
+}
+
+// probeUDP checks whether sock relays UDP by sending a DNS query to our UDP probe target through it.
+func (p5 *ProxyEngine) probeUDP(sock *Proxy) {
+	pc, err := p5.associateThrough(sock, p5.GetValidationTimeout())
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	query, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	if _, err = pc.WriteTo(query, udpHostAddr(p5.GetUDPProbeTarget())); err != nil {
+		return
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(p5.GetValidationTimeout()))
+	buf := make([]byte, 512)
+	if _, _, err = pc.ReadFrom(buf); err != nil {
+		// the proxy agreed to relay, but nothing came back.
+		atomic.StoreUint32(&sock.udp, udpUnsupported)
+	}
+}
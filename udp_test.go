@@ -0,0 +1,224 @@
+package prox5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.tcp.direct/kayos/go-socks5"
+	"git.tcp.direct/kayos/go-socks5/statute"
+)
+
+// newUDPSOCKSServer starts a SOCKS5 server that relays UDP, or refuses to if noUDP is set.
+func newUDPSOCKSServer(t *testing.T, noUDP bool) string {
+	t.Helper()
+	opts := []socks5.Option{}
+	if noUDP {
+		opts = append(opts, socks5.WithAssociateHandle(func(_ context.Context, w io.Writer, _ *socks5.Request) error {
+			return socks5.SendReply(w, statute.RepCommandNotSupported, nil)
+		}))
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = socks5.NewServer(opts...).Serve(ln)
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	return ln.Addr().String()
+}
+
+// newUDPEchoServer answers every datagram with the same datagram.
+func newUDPEchoServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], from)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestListenPacket(t *testing.T) {
+	echo := newUDPEchoServer(t)
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	refuser := addValidatedProxy(t, p5, newUDPSOCKSServer(t, true), ProtoSOCKS5)
+	relay := addValidatedProxy(t, p5, newUDPSOCKSServer(t, false), ProtoSOCKS5)
+	p5.anothaOne()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pc, err := p5.ListenPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = pc.Close()
+	}()
+
+	if supported, known := refuser.GetUDPSupport(); supported || !known {
+		t.Errorf("expected the refusing proxy to be recorded as unsupported, got %t (known: %t)", supported, known)
+	}
+	if supported, _ := relay.GetUDPSupport(); !supported {
+		t.Error("expected the relaying proxy to be recorded as supported")
+	}
+
+	echoAddr, _ := net.ResolveUDPAddr("udp", echo)
+	if _, err = pc.WriteTo([]byte("hello"), echoAddr); err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" || from.String() != echo {
+		t.Fatalf("unexpected datagram %q from %s", buf[:n], from)
+	}
+
+	t.Run("dial", func(t *testing.T) {
+		p5.enqueue(relay)
+		conn, err := p5.DialContext(ctx, "udp", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		if _, err = conn.Write([]byte("again")); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err = conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "again" {
+			t.Fatalf("unexpected datagram %q", buf[:n])
+		}
+	})
+
+	t.Run("server", func(t *testing.T) {
+		p5.enqueue(relay)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listen := ln.Addr().String()
+		_ = ln.Close()
+		go func() {
+			_ = p5.StartSOCKS5Server(listen, "", "")
+		}()
+
+		var ctrl net.Conn
+		for i := 0; i < 50; i++ {
+			if ctrl, err = net.Dial("tcp", listen); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		relayAddr, err := udpAssociate(ctrl, nil, 2*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := newSocksPacketConn(conn, relayAddr, ctrl)
+		defer func() {
+			_ = client.Close()
+		}()
+		if _, err = client.WriteTo([]byte("relayed"), echoAddr); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, _, err = client.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "relayed" {
+			t.Fatalf("unexpected datagram %q", buf[:n])
+		}
+	})
+
+	t.Run("probe", func(t *testing.T) {
+		p5.SetUDPProbeTarget(echo)
+		sock := &Proxy{Endpoint: newUDPSOCKSServer(t, false), protocol: newImmutableProto(), parent: p5}
+		sock.protocol.set(ProtoSOCKS5)
+		p5.probeUDP(sock)
+		if supported, known := sock.GetUDPSupport(); !supported || !known {
+			t.Fatalf("expected the probe to find UDP support, got %t (known: %t)", supported, known)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		shortCtx, shortCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer shortCancel()
+		if _, err := p5.ListenPacket(shortCtx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("proxies known to refuse UDP should be skipped, got %v", err)
+		}
+	})
+}
+
+func TestProbeUDPTimeout(t *testing.T) {
+	// accepts our connection and never answers the handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer func() {
+				_ = c.Close()
+			}()
+		}
+	}()
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(time.Minute)
+	p5.SetValidationTimeout(200 * time.Millisecond)
+	sock, _ := p5.proxyMap.add(ln.Addr().String())
+
+	start := time.Now()
+	p5.probeUDP(sock)
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("expected our probe to give up after the validation timeout, took %s", took)
+	}
+}
@@ -0,0 +1,159 @@
+package prox5
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UsernameParams are the routing parameters a client of our servers may append to its username, see EnableUsernameParams.
+// e.g. alice-country-de-session-abc123 authenticates as alice, exits in Germany, and sticks to one proxy for session abc123.
+type UsernameParams struct {
+	Countries []string
+	ASNs      []uint
+	Protocols []ProxyProtocol
+	Session   string
+}
+
+// ParseUsername splits a username into the base username and its routing parameters, see EnableUsernameParams.
+// Parameters are dash separated key-value pairs following the base username. Supported keys are country, asn, proto,
+// and session. country, asn, and proto may be given more than once, or as comma separated lists, to allow several.
+// Session IDs may contain dashes when session is the last key, e.g. alice-country-de-session-abc-123.
+func ParseUsername(username string) (base string, params UsernameParams, err error) {
+	parts := strings.Split(username, "-")
+	start := len(parts)
+	for i, part := range parts {
+		if i > 0 && isUsernameParam(part) {
+			start = i
+			break
+		}
+	}
+	base = strings.Join(parts[:start], "-")
+	rest := parts[start:]
+	for i := 0; i < len(rest); i += 2 {
+		key := strings.ToLower(rest[i])
+		if i+1 == len(rest) {
+			return "", UsernameParams{}, fmt.Errorf("username parameter %q is missing a value", key)
+		}
+		value := rest[i+1]
+		if key == "session" && lastUsernameParam(rest[i+1:]) {
+			value = strings.Join(rest[i+1:], "-")
+			i = len(rest)
+		}
+		if value == "" {
+			return "", UsernameParams{}, fmt.Errorf("username parameter %q is missing a value", key)
+		}
+		switch key {
+		case "country":
+			for _, code := range strings.Split(value, ",") {
+				params.Countries = append(params.Countries, strings.ToUpper(code))
+			}
+		case "asn":
+			for _, num := range strings.Split(value, ",") {
+				asn, perr := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(num), "AS"), 10, 32)
+				if perr != nil {
+					return "", UsernameParams{}, fmt.Errorf("bad asn %q in username: %w", num, perr)
+				}
+				params.ASNs = append(params.ASNs, uint(asn))
+			}
+		case "proto":
+			for _, name := range strings.Split(value, ",") {
+				proto := protoFromString(strings.ToLower(name))
+				if proto == ProtoNull {
+					return "", UsernameParams{}, fmt.Errorf("unknown proto %q in username", name)
+				}
+				params.Protocols = append(params.Protocols, proto)
+			}
+		case "session":
+			params.Session = value
+		default:
+			return "", UsernameParams{}, fmt.Errorf("unknown username parameter %q", key)
+		}
+	}
+	return base, params, nil
+}
+
+// lastUsernameParam reports whether none of parts is a username parameter key.
+func lastUsernameParam(parts []string) bool {
+	for _, part := range parts {
+		if isUsernameParam(part) {
+			return false
+		}
+	}
+	return true
+}
+
+func isUsernameParam(key string) bool {
+	switch strings.ToLower(key) {
+	case "country", "asn", "proto", "session":
+		return true
+	}
+	return false
+}
+
+// context applies the parameters to ctx, session IDs are kept apart per base user.
+func (up UsernameParams) context(ctx context.Context, base string) context.Context {
+	var filters []ProxyFilter
+	if len(up.Countries) > 0 {
+		filters = append(filters, InCountries(up.Countries...))
+	}
+	if len(up.ASNs) > 0 {
+		filters = append(filters, InASNs(up.ASNs...))
+	}
+	if len(up.Protocols) > 0 {
+		filters = append(filters, InProtocols(up.Protocols...))
+	}
+	if filter := allFilters(filters...); filter != nil {
+		ctx = WithFilter(ctx, filter)
+	}
+	if up.Session != "" {
+		ctx = WithSession(ctx, "user:"+base+":"+up.Session)
+	}
+	return ctx
+}
+
+// serverAuth is an authenticated client of one of our servers.
+type serverAuth struct {
+	// grant is set when the client authenticated through our UserStore.
+	grant *userGrant
+	// base is the username the client authenticated as, without any routing parameters.
+	base   string
+	params UsernameParams
+}
+
+// context narrows down the proxies dispensed for ctx to those allowed by the client's policy and asked for by its
+// username parameters.
+func (sa *serverAuth) context(ctx context.Context) context.Context {
+	if sa.grant != nil {
+		ctx = sa.grant.context(ctx)
+	}
+	return sa.params.context(ctx, sa.base)
+}
+
+// authenticateClient checks the credentials of a client of one of our servers against our UserStore, falling back to
+// the server's own username and password. If username parameters are enabled they are split off the username first.
+func (p5 *ProxyEngine) authenticateClient(username, password, serverUser, serverPass string) (*serverAuth, bool) {
+	auth := &serverAuth{base: username}
+	if p5.GetUsernameParamsStatus() {
+		var err error
+		if auth.base, auth.params, err = ParseUsername(username); err != nil {
+			p5.DebugLogger.Printf("prox5 refused username %q: %v", username, err)
+			return nil, false
+		}
+	}
+	if grant, ok := p5.authenticateUser(auth.base, password); ok {
+		auth.grant = grant
+		return auth, true
+	}
+	if serverUser == "" || serverPass == "" {
+		return nil, false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(auth.base), []byte(serverUser)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(password), []byte(serverPass)) == 1
+	if !userOK || !passOK {
+		return nil, false
+	}
+	return auth, true
+}
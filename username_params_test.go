@@ -0,0 +1,116 @@
+package prox5
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		base     string
+		params   UsernameParams
+		wantErr  bool
+	}{
+		{username: "alice", base: "alice"},
+		{username: "alice-smith", base: "alice-smith"},
+		{
+			username: "alice-country-de-session-abc123",
+			base:     "alice",
+			params:   UsernameParams{Countries: []string{"DE"}, Session: "abc123"},
+		},
+		{
+			username: "alice-smith-country-de,fr-asn-AS13335-proto-socks5",
+			base:     "alice-smith",
+			params: UsernameParams{
+				Countries: []string{"DE", "FR"},
+				ASNs:      []uint{13335},
+				Protocols: []ProxyProtocol{ProtoSOCKS5},
+			},
+		},
+		{username: "alice-session-abc-123", base: "alice", params: UsernameParams{Session: "abc-123"}},
+		{
+			username: "alice-country-de-session-abc-123",
+			base:     "alice",
+			params:   UsernameParams{Countries: []string{"DE"}, Session: "abc-123"},
+		},
+		{username: "alice-session-abc-123-country-de", wantErr: true},
+		{username: "alice-country", wantErr: true},
+		{username: "alice-country-de-bogus-x", wantErr: true},
+		{username: "alice-proto-ftp", wantErr: true},
+		{username: "alice-asn-cloudflare", wantErr: true},
+	}
+	for _, tt := range tests {
+		base, params, err := ParseUsername(tt.username)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseUsername(%q) error = %v, wantErr %t", tt.username, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if base != tt.base || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("ParseUsername(%q) = %q, %+v, want %q, %+v", tt.username, base, params, tt.base, tt.params)
+		}
+	}
+}
+
+func TestUsernameParamsRouting(t *testing.T) {
+	target := newTCPEchoServer(t)
+	first, second := newDummyHTTPProxy(t, "", ""), newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	p5.EnableUsernameParams()
+	addValidatedProxy(t, p5, first.Addr().String(), ProtoHTTP)
+	addValidatedProxy(t, p5, second.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := p5.NewSOCKS5Server("user", "pass")
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	defer func() {
+		_ = srv.Close()
+	}()
+	proxyAddr := ln.Addr().String()
+
+	if _, err = dialTestSOCKS5(proxyAddr, "user-bogus-x:pass", target); err == nil {
+		t.Fatal("expected unknown username parameters to be refused")
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := dialTestSOCKS5(proxyAddr, "user-session-abc:pass", target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		echoThrough(t, conn, "hello")
+		for _, session := range srv.Sessions() {
+			if session.User != "user" {
+				t.Errorf("expected sessions to belong to our base username, got %q", session.User)
+			}
+		}
+		_ = conn.Close()
+	}
+	if got := first.tunnels.Load() + second.tunnels.Load(); got != 3 {
+		t.Fatalf("expected 3 tunnels through our pool, got %d", got)
+	}
+	if first.tunnels.Load() != 0 && second.tunnels.Load() != 0 {
+		t.Fatalf("expected our session to stick to one proxy, got %d and %d",
+			first.tunnels.Load(), second.tunnels.Load())
+	}
+
+	if _, err = dialTestSOCKS5(proxyAddr, "user-proto-socks5:pass", target); err == nil {
+		t.Fatal("expected a dial restricted to SOCKS5 proxies to fail, we only have HTTP proxies")
+	}
+}
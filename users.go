@@ -0,0 +1,397 @@
+package prox5
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrPolicyDenied is returned when a user's policy does not allow them to reach a destination.
+	ErrPolicyDenied = errors.New("denied by user policy")
+	// ErrTooManyConns is returned when a user already has as many connections open as their policy allows.
+	ErrTooManyConns = errors.New("user has too many connections open")
+	// ErrQuotaExceeded is returned once a user has moved as many bytes through our servers as their policy allows.
+	ErrQuotaExceeded = errors.New("user byte quota exceeded")
+)
+
+// UserPolicy limits what an authenticated user of our servers may do, see SetUserStore. The zero value allows everything.
+type UserPolicy struct {
+	// Protocols restricts the user to proxies of these protocols.
+	Protocols []ProxyProtocol
+	// Countries restricts the user to proxies that exit in these ISO country codes, see SetGeoIPDatabase.
+	Countries []string
+	// MaxConns limits how many connections the user may have open at once.
+	MaxConns int
+	// ByteQuota limits how many bytes the user may move through our servers in total, in both directions.
+	ByteQuota int64
+	// Ports restricts the destination ports the user may connect to.
+	Ports []int
+	// Hosts restricts the destination hosts the user may connect to. Entries starting with "*." match any subdomain.
+	Hosts []string
+}
+
+// UserStore authenticates the users of our servers and hands back their policy, see SetUserStore.
+type UserStore interface {
+	Authenticate(username, password string) (UserPolicy, bool)
+}
+
+// UserStoreFunc lets an ordinary function act as a UserStore, e.g. to check credentials against an external service.
+type UserStoreFunc func(username, password string) (UserPolicy, bool)
+
+func (f UserStoreFunc) Authenticate(username, password string) (UserPolicy, bool) {
+	return f(username, password)
+}
+
+type memoryUser struct {
+	// secret is either a plaintext password or an htpasswd hash, see check.
+	secret string
+	hashed bool
+	policy UserPolicy
+}
+
+// MemoryUserStore is a UserStore kept in memory, see NewMemoryUserStore and LoadHtpasswd.
+type MemoryUserStore struct {
+	users map[string]memoryUser
+	mu    *sync.RWMutex
+}
+
+// NewMemoryUserStore returns an empty MemoryUserStore.
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users: make(map[string]memoryUser),
+		mu:    &sync.RWMutex{},
+	}
+}
+
+// Set adds or replaces username with the given password and policy.
+func (ms *MemoryUserStore) Set(username, password string, policy UserPolicy) {
+	ms.mu.Lock()
+	ms.users[username] = memoryUser{secret: password, policy: policy}
+	ms.mu.Unlock()
+}
+
+// Remove removes username from the store.
+func (ms *MemoryUserStore) Remove(username string) {
+	ms.mu.Lock()
+	delete(ms.users, username)
+	ms.mu.Unlock()
+}
+
+func (ms *MemoryUserStore) Authenticate(username, password string) (UserPolicy, bool) {
+	ms.mu.RLock()
+	user, ok := ms.users[username]
+	ms.mu.RUnlock()
+	if !ok || !user.check(password) {
+		return UserPolicy{}, false
+	}
+	return user.policy, true
+}
+
+func (mu memoryUser) check(password string) bool {
+	if !mu.hashed {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(mu.secret)) == 1
+	}
+	switch {
+	case strings.HasPrefix(mu.secret, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(mu.secret), []byte(password)) == nil
+	case strings.HasPrefix(mu.secret, "{SHA}"):
+		sum := sha1.Sum([]byte(password)) //nolint:gosec
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(strings.TrimPrefix(mu.secret, "{SHA}"))) == 1
+	case strings.HasPrefix(mu.secret, "{PLAIN}"):
+		return subtle.ConstantTimeCompare([]byte(password), []byte(strings.TrimPrefix(mu.secret, "{PLAIN}"))) == 1
+	default:
+		return false
+	}
+}
+
+// LoadHtpasswd reads an htpasswd-style file of username:hash lines into a MemoryUserStore, giving every user policy.
+// bcrypt ($2y$), {SHA}, and {PLAIN} (plaintext) entries are supported, anything else such as crypt(3) is rejected.
+// Use Set on the result to give users their own policy.
+func LoadHtpasswd(path string, policy UserPolicy) (*MemoryUserStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	store := NewMemoryUserStore()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		username, secret, ok := strings.Cut(entry, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: malformed entry", path, line)
+		}
+		if !strings.HasPrefix(secret, "$2") && !strings.HasPrefix(secret, "{SHA}") && !strings.HasPrefix(secret, "{PLAIN}") {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %s, use bcrypt, {SHA} or {PLAIN}", path, line, username)
+		}
+		store.users[username] = memoryUser{secret: secret, hashed: true, policy: policy}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// UserUsage is how much a user has used our servers, see GetUserUsage.
+type UserUsage struct {
+	ActiveConns int64
+	TotalConns  int64
+	// BytesIn were received from the user, BytesOut were sent to them.
+	BytesIn  int64
+	BytesOut int64
+}
+
+type userUsage struct {
+	active *atomic.Int64
+	total  *atomic.Int64
+	in     *atomic.Int64
+	out    *atomic.Int64
+}
+
+func (uu *userUsage) snapshot() UserUsage {
+	return UserUsage{
+		ActiveConns: uu.active.Load(),
+		TotalConns:  uu.total.Load(),
+		BytesIn:     uu.in.Load(),
+		BytesOut:    uu.out.Load(),
+	}
+}
+
+// userTable counts the usage of each user of our servers.
+type userTable struct {
+	users map[string]*userUsage
+	mu    *sync.Mutex
+}
+
+func newUserTable() *userTable {
+	return &userTable{
+		users: make(map[string]*userUsage),
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (ut *userTable) get(username string) *userUsage {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	uu, ok := ut.users[username]
+	if !ok {
+		uu = &userUsage{
+			active: &atomic.Int64{},
+			total:  &atomic.Int64{},
+			in:     &atomic.Int64{},
+			out:    &atomic.Int64{},
+		}
+		ut.users[username] = uu
+	}
+	return uu
+}
+
+// GetUserUsage returns how much username has used our servers, see SetUserStore.
+func (p5 *ProxyEngine) GetUserUsage(username string) (UserUsage, bool) {
+	p5.users.mu.Lock()
+	uu, ok := p5.users.users[username]
+	p5.users.mu.Unlock()
+	if !ok {
+		return UserUsage{}, false
+	}
+	return uu.snapshot(), true
+}
+
+// GetUsersUsage returns how much each user has used our servers, keyed by username.
+func (p5 *ProxyEngine) GetUsersUsage() map[string]UserUsage {
+	p5.users.mu.Lock()
+	defer p5.users.mu.Unlock()
+	usage := make(map[string]UserUsage, len(p5.users.users))
+	for name, uu := range p5.users.users {
+		usage[name] = uu.snapshot()
+	}
+	return usage
+}
+
+// ResetUserUsage zeroes the byte counters of username, e.g. to start a new quota period.
+func (p5 *ProxyEngine) ResetUserUsage(username string) {
+	uu := p5.users.get(username)
+	uu.in.Store(0)
+	uu.out.Store(0)
+}
+
+// userGrant is an authenticated user of one of our servers along with their policy.
+type userGrant struct {
+	name   string
+	policy UserPolicy
+	usage  *userUsage
+}
+
+// authenticateUser checks username and password against our UserStore, if one is set.
+func (p5 *ProxyEngine) authenticateUser(username, password string) (*userGrant, bool) {
+	store := p5.GetUserStore()
+	if store == nil {
+		return nil, false
+	}
+	policy, ok := store.Authenticate(username, password)
+	if !ok {
+		return nil, false
+	}
+	return &userGrant{name: username, policy: policy, usage: p5.users.get(username)}, true
+}
+
+func (g *userGrant) allowsTarget(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if len(g.policy.Ports) > 0 {
+		port, _ := strconv.Atoi(portStr)
+		allowed := false
+		for _, p := range g.policy.Ports {
+			if p == port {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(g.policy.Hosts) == 0 {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, h := range g.policy.Hosts {
+		h = strings.ToLower(h)
+		if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *userGrant) overQuota() bool {
+	return g.policy.ByteQuota > 0 && g.usage.in.Load()+g.usage.out.Load() >= g.policy.ByteQuota
+}
+
+// admit checks that the user may connect to addr and takes up one of their connections, see release.
+func (g *userGrant) admit(addr string) error {
+	if !g.allowsTarget(addr) {
+		return ErrPolicyDenied
+	}
+	if g.overQuota() {
+		return ErrQuotaExceeded
+	}
+	for {
+		active := g.usage.active.Load()
+		if g.policy.MaxConns > 0 && active >= int64(g.policy.MaxConns) {
+			return ErrTooManyConns
+		}
+		if g.usage.active.CompareAndSwap(active, active+1) {
+			break
+		}
+	}
+	g.usage.total.Add(1)
+	return nil
+}
+
+func (g *userGrant) release() {
+	g.usage.active.Add(-1)
+}
+
+// context narrows down the proxies dispensed for ctx to those allowed by the user's policy.
+func (g *userGrant) context(ctx context.Context) context.Context {
+	var filters []ProxyFilter
+	if len(g.policy.Protocols) > 0 {
+		filters = append(filters, InProtocols(g.policy.Protocols...))
+	}
+	if len(g.policy.Countries) > 0 {
+		filters = append(filters, InCountries(g.policy.Countries...))
+	}
+	if filter := allFilters(filters...); filter != nil {
+		return WithFilter(ctx, filter)
+	}
+	return ctx
+}
+
+// count adds to the user's byte counters, returning ErrQuotaExceeded once they have gone over their quota.
+func (g *userGrant) count(in, out int) error {
+	g.usage.in.Add(int64(in))
+	g.usage.out.Add(int64(out))
+	if g.overQuota() {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// grantConn counts the bytes moved through a user's connection against their quota.
+type grantConn struct {
+	net.Conn
+	grant *userGrant
+}
+
+func (gc grantConn) Read(b []byte) (int, error) {
+	n, err := gc.Conn.Read(b)
+	if qerr := gc.grant.count(n, 0); qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
+
+func (gc grantConn) Write(b []byte) (int, error) {
+	if gc.grant.overQuota() {
+		return 0, ErrQuotaExceeded
+	}
+	n, err := gc.Conn.Write(b)
+	_ = gc.grant.count(0, n)
+	return n, err
+}
+
+// grantReader counts the bytes read from a body going to or coming from a user against their quota, see grantConn.
+type grantReader struct {
+	io.ReadCloser
+	grant *userGrant
+	// in is true for bodies sent by the user.
+	in bool
+}
+
+func (gr grantReader) Read(b []byte) (int, error) {
+	if quota := gr.grant.policy.ByteQuota; quota > 0 {
+		left := quota - gr.grant.usage.in.Load() - gr.grant.usage.out.Load()
+		if left <= 0 {
+			return 0, ErrQuotaExceeded
+		}
+		if int64(len(b)) > left {
+			b = b[:left]
+		}
+	}
+	n, err := gr.ReadCloser.Read(b)
+	var qerr error
+	if gr.in {
+		qerr = gr.grant.count(n, 0)
+	} else {
+		qerr = gr.grant.count(0, n)
+	}
+	if qerr != nil && err == nil {
+		err = qerr
+	}
+	return n, err
+}
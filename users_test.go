@@ -0,0 +1,206 @@
+package prox5
+
+import (
+	"crypto/sha1" //nolint:gosec
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadHtpasswd(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte("swordfish")) //nolint:gosec
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	contents := "# teams\nalice:" + string(hash) + "\nbob:{SHA}" + base64.StdEncoding.EncodeToString(sum[:]) + "\ncarol:{PLAIN}plain\n"
+	if err = os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := LoadHtpasswd(path, UserPolicy{MaxConns: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, pass := range map[string]string{"alice": "hunter2", "bob": "swordfish", "carol": "plain"} {
+		policy, ok := store.Authenticate(user, pass)
+		if !ok {
+			t.Errorf("expected %s to authenticate", user)
+		}
+		if policy.MaxConns != 3 {
+			t.Errorf("expected %s to be given our default policy", user)
+		}
+		if _, ok = store.Authenticate(user, pass+"nope"); ok {
+			t.Errorf("expected %s to be refused with the wrong password", user)
+		}
+	}
+
+	for _, entry := range []string{"dave:$apr1$salt$hash", "erin:rl.3StKT.4T8M", "frank:plain"} {
+		if err = os.WriteFile(path, []byte(entry+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = LoadHtpasswd(path, UserPolicy{}); err == nil {
+			t.Fatalf("expected %q to be rejected", entry)
+		}
+	}
+}
+
+func TestUserPolicy(t *testing.T) {
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	store := NewMemoryUserStore()
+	store.Set("alice", "secret", UserPolicy{
+		MaxConns:  1,
+		ByteQuota: 10,
+		Ports:     []int{443},
+		Hosts:     []string{"example.com", "*.example.org"},
+	})
+	p5.SetUserStore(store)
+
+	if _, ok := p5.authenticateUser("alice", "wrong"); ok {
+		t.Fatal("expected the wrong password to be refused")
+	}
+	g, ok := p5.authenticateUser("alice", "secret")
+	if !ok {
+		t.Fatal("expected alice to authenticate")
+	}
+
+	for target, want := range map[string]bool{
+		"example.com:443":     true,
+		"www.example.org:443": true,
+		"example.com:80":      false,
+		"example.net:443":     false,
+	} {
+		if got := g.allowsTarget(target); got != want {
+			t.Errorf("allowsTarget(%q) = %t, want %t", target, got, want)
+		}
+	}
+
+	if err := g.admit("example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.admit("example.com:443"); !errors.Is(err, ErrTooManyConns) {
+		t.Fatalf("expected ErrTooManyConns, got %v", err)
+	}
+	g.release()
+	if err := g.count(6, 6); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	if err := g.admit("example.com:443"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected users over quota to be refused, got %v", err)
+	}
+
+	usage, ok := p5.GetUserUsage("alice")
+	if !ok || usage.TotalConns != 1 || usage.ActiveConns != 0 || usage.BytesIn != 6 || usage.BytesOut != 6 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+	p5.ResetUserUsage("alice")
+	if err := g.admit("example.com:443"); err != nil {
+		t.Fatalf("expected a reset quota to admit alice again, got %v", err)
+	}
+
+	g.release()
+
+	body := grantReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", 64))), grant: g}
+	read, err := io.Copy(io.Discard, body)
+	if !errors.Is(err, ErrQuotaExceeded) || read != 10 {
+		t.Fatalf("expected bodies to be cut off at the quota, read %d bytes (%v)", read, err)
+	}
+	if usage, _ = p5.GetUserUsage("alice"); usage.BytesOut != read || usage.BytesIn != 0 {
+		t.Fatalf("expected response bodies to count as sent to alice, got %+v", usage)
+	}
+}
+
+func TestServerUsers(t *testing.T) {
+	target := newTCPEchoServer(t)
+	_, targetPort, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(targetPort)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetServerTimeout(2 * time.Second)
+	p5.DisableRecycling()
+	sock := addValidatedProxy(t, p5, upstream.Addr().String(), ProtoHTTP)
+	p5.anothaOne()
+
+	store := NewMemoryUserStore()
+	store.Set("alice", "secret", UserPolicy{MaxConns: 1, Ports: []int{port}})
+	store.Set("bob", "secret", UserPolicy{Protocols: []ProxyProtocol{ProtoSOCKS5}})
+	p5.SetUserStore(store)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := p5.NewSOCKS5Server("", "")
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	defer func() {
+		_ = srv.Close()
+	}()
+	proxyAddr := ln.Addr().String()
+
+	if _, err = dialTestSOCKS5(proxyAddr, "alice:wrong", target); err == nil {
+		t.Fatal("expected the wrong password to be refused")
+	}
+
+	conn, err := dialTestSOCKS5(proxyAddr, "alice:secret", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	echoThrough(t, conn, "hello")
+	if sessions := srv.Sessions(); len(sessions) != 1 || sessions[0].User != "alice" {
+		t.Fatalf("expected one session belonging to alice, got %+v", sessions)
+	}
+
+	p5.enqueue(sock)
+	if _, err = dialTestSOCKS5(proxyAddr, "alice:secret", target); err == nil {
+		t.Fatal("expected alice to be limited to one connection")
+	}
+	if _, err = dialTestSOCKS5(proxyAddr, "bob:secret", target); err == nil {
+		t.Fatal("expected bob to be limited to SOCKS5 proxies, of which we have none")
+	}
+
+	usage, _ := p5.GetUserUsage("alice")
+	if usage.ActiveConns != 1 || usage.BytesIn < int64(len("hello")) || usage.BytesOut < int64(len("hello")) {
+		t.Fatalf("unexpected usage for alice: %+v", usage)
+	}
+
+	t.Run("http", func(t *testing.T) {
+		store.Set("carol", "secret", UserPolicy{Hosts: []string{"example.com"}})
+		hp := httptest.NewServer(p5.newHTTPProxy("", ""))
+		defer hp.Close()
+		proxyURL, _ := url.Parse("http://carol:secret@" + strings.TrimPrefix(hp.URL, "http://"))
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+		resp, err := client.Get("http://" + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected %d, got %d", http.StatusForbidden, resp.StatusCode)
+		}
+	})
+}
@@ -2,11 +2,11 @@ package prox5
 
 import (
 	"bytes"
-	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
@@ -28,8 +28,8 @@ var headerPool = sync.Pool{
 	},
 }
 
-func (p5 *ProxyEngine) prepHTTP() (*http.Client, *http.Transport, *http.Request, error) {
-	req, err := http.NewRequest("GET", p5.GetRandomEndpoint(), bytes.NewBuffer([]byte("")))
+func (p5 *ProxyEngine) prepHTTP(hmd *handMeDown) (*http.Client, *http.Transport, *http.Request, error) {
+	req, err := http.NewRequest("GET", hmd.endpoint, bytes.NewBuffer([]byte("")))
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -39,7 +39,7 @@ func (p5 *ProxyEngine) prepHTTP() (*http.Client, *http.Transport, *http.Request,
 	var client = &http.Client{}
 	var transporter = &http.Transport{
 		DisableKeepAlives:   true,
-		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		TLSClientConfig:     p5.validationTLSConfig(hmd.endpoint, hmd.tlsCheck),
 		TLSHandshakeTimeout: p5.GetValidationTimeout(),
 	}
 
@@ -55,32 +55,32 @@ func (sock *Proxy) good() {
 	sock.lastValidated = time.Now()
 }
 
-func httpEndpoint(hmd *handMeDown) (func(r *http.Request) (*url.URL, error), error) {
-	s := strs.Get()
-	defer strs.MustPut(s)
-	s.MustWriteString("http://")
-	s.MustWriteString(hmd.sock.Endpoint)
-	purl, err := url.Parse(s.String())
-	if err != nil {
-		return nil, err
+// validationHandshaker returns a dial function that tunnels through sock over conn, speaking protocol.
+// Unlike handshaker, the protocol of sock may not be known yet.
+func (p5 *ProxyEngine) validationHandshaker(sock *Proxy, protocol ProxyProtocol, conn net.Conn) func(network, addr string) (net.Conn, error) {
+	if protocol == ProtoHTTP {
+		return dialHTTPWithConn(sock.Endpoint, conn, p5.GetValidationTimeout())
 	}
-	return http.ProxyURL(purl), nil
-}
-
-func (p5 *ProxyEngine) bakeHTTP(hmd *handMeDown) (client *http.Client, req *http.Request, err error) {
 	builder := strs.Get()
-	builder.MustWriteString(hmd.protoCheck.String())
+	defer strs.MustPut(builder)
+	builder.MustWriteString(protocol.String())
 	builder.MustWriteString("://")
-	builder.MustWriteString(hmd.sock.Endpoint)
+	builder.MustWriteString(sock.Endpoint)
 	builder.MustWriteString("/?timeout=")
 	builder.MustWriteString(p5.GetValidationTimeoutStr())
 	builder.MustWriteString("s")
-	dialSocks := socks.DialWithConn(builder.String(), hmd.conn)
-	strs.MustPut(builder)
+	return socks.DialWithConn(builder.String(), conn)
+}
+
+func (p5 *ProxyEngine) bakeHTTP(hmd *handMeDown) (client *http.Client, req *http.Request, err error) {
+	if hmd.protoCheck == ProtoHTTP && hmd.forward {
+		return p5.bakeForwardHTTP(hmd)
+	}
+	dial := p5.validationHandshaker(hmd.sock, hmd.protoCheck, hmd.conn)
 
 	var transport *http.Transport
 
-	client, transport, req, err = p5.prepHTTP()
+	client, transport, req, err = p5.prepHTTP(hmd)
 	if err != nil {
 		if req != nil && req.Header != nil {
 			headerPool.Put(req.Header)
@@ -88,13 +88,23 @@ func (p5 *ProxyEngine) bakeHTTP(hmd *handMeDown) (client *http.Client, req *http
 		return
 	}
 
-	if hmd.protoCheck != ProtoHTTP {
-		transport.Dial = dialSocks
-		client.Transport = transport
-		return
+	transport.Dial = func(network, addr string) (net.Conn, error) {
+		start := time.Now()
+		conn, dialErr := dial(network, addr)
+		hmd.timings.Handshake = time.Since(start)
+		hmd.tunneled = dialErr == nil
+		return conn, dialErr
 	}
+	client.Transport = transport
+	return
+}
+
+// bakeForwardHTTP prepares a request that an HTTP proxy forwards for us, rather than tunneling it with CONNECT.
+// Plain HTTP requests sent this way give the proxy a chance to add headers to them, see judgeAnonymity.
+func (p5 *ProxyEngine) bakeForwardHTTP(hmd *handMeDown) (client *http.Client, req *http.Request, err error) {
+	var transport *http.Transport
 
-	proxyURL, err := httpEndpoint(hmd)
+	client, transport, req, err = p5.prepHTTP(hmd)
 	if err != nil {
 		if req != nil && req.Header != nil {
 			headerPool.Put(req.Header)
@@ -102,7 +112,12 @@ func (p5 *ProxyEngine) bakeHTTP(hmd *handMeDown) (client *http.Client, req *http
 		return
 	}
 
-	transport.Proxy = proxyURL
+	auth, addr := splitEndpoint(hmd.sock.Endpoint)
+	transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", User: auth, Host: addr})
+	transport.Dial = func(network, addr string) (net.Conn, error) {
+		return hmd.conn, nil
+	}
+	client.Transport = transport
 	return
 }
 
@@ -118,7 +133,20 @@ func (p5 *ProxyEngine) validate(hmd *handMeDown) (string, error) {
 		return "", err
 	}
 
-	resp, err := client.Do(req)
+	// these are called from different goroutines within the transport
+	wroteRequest := &atomic.Int64{}
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			wroteRequest.Store(time.Now().UnixNano())
+		},
+		GotFirstResponseByte: func() {
+			if wrote := wroteRequest.Load(); wrote != 0 {
+				hmd.timings.FirstByte = time.Since(time.Unix(0, wrote))
+			}
+		},
+	}
+
+	resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
 	defer func() {
 		if req != nil && req.Header != nil {
 			headerPool.Put(req.Header)
@@ -142,6 +170,17 @@ type handMeDown struct {
 	protoCheck ProxyProtocol
 	conn       net.Conn
 	under      proxy.Dialer
+	timings    Timings
+	// endpoint is the URL we will be requesting through the proxy.
+	endpoint string
+	// forward, for HTTP proxies, sends our request to the proxy as-is instead of tunneling it with CONNECT.
+	forward bool
+	// resp is what endpoint answered with.
+	resp string
+	// tunneled is set once the proxy has connected us to endpoint.
+	tunneled bool
+	// tlsCheck holds what we made of the certificate presented for endpoint.
+	tlsCheck *tlsCheck
 }
 
 func (hmd *handMeDown) Dial(network, addr string) (c net.Conn, err error) {
@@ -169,35 +208,98 @@ func (p5 *ProxyEngine) announceValidating(sock *Proxy, presplit string) {
 
 func (p5 *ProxyEngine) singleProxyCheck(sock *Proxy, protocol ProxyProtocol) error {
 	defer p5.anothaOne()
-	split := strings.Split(sock.Endpoint, "@")
-	endpoint := split[0]
-	if len(split) == 2 {
-		endpoint = split[1]
-	}
-
-	// p5.announceValidating(sock, endpoint)
 
-	conn, err := net.DialTimeout("tcp", endpoint, p5.GetValidationTimeout())
+	var err error
+	if validators := p5.GetValidators(); len(validators) > 0 {
+		err = p5.validatorCheck(sock, protocol, validators)
+	} else {
+		err = p5.ipEchoCheck(sock, protocol)
+	}
 	if err != nil {
 		return err
 	}
 
-	hmd := &handMeDown{sock: sock, conn: conn, under: proxy.Direct, protoCheck: protocol}
+	p5.enrichGeo(sock)
 
-	resp, err := p5.validate(hmd)
+	if judge := p5.GetJudgeEndpoint(); judge != "" {
+		p5.judgeAnonymity(sock, protocol, judge)
+	}
+
+	if protocol == ProtoSOCKS5 && p5.GetUDPProbeStatus() {
+		p5.probeUDP(sock)
+	}
+
+	return nil
+}
+
+// ipEchoCheck is our default check, it requests one of our check endpoints through sock and expects an IP address back.
+// If the proxy got us through to the endpoint but we didn't get an IP address back, another endpoint is given a try
+// before the proxy is blamed, see GetEndpointHealth.
+func (p5 *ProxyEngine) ipEchoCheck(sock *Proxy, protocol ProxyProtocol) error {
+	consensus := p5.GetExitConsensus()
+	if consensus > 1 && sock.IsUntrusted() {
+		return ErrUntrusted
+	}
+	checkEndpoint := p5.GetRandomEndpoint()
+	answered := checkEndpoint
+	hmd, err := p5.ipEcho(sock, protocol, checkEndpoint)
+	switch {
+	case err == nil:
+		p5.endpoints.success(checkEndpoint)
+	case hmd == nil || !hmd.tunneled:
+	default:
+		retryEndpoint := p5.pickEndpoint(checkEndpoint)
+		if retryEndpoint == "" {
+			break
+		}
+		retry, retryErr := p5.ipEcho(sock, protocol, retryEndpoint)
+		if retryErr != nil {
+			break
+		}
+		p5.endpointFailed(checkEndpoint)
+		p5.endpoints.success(retryEndpoint)
+		hmd, err, answered = retry, nil, retryEndpoint
+	}
+	if err == nil && consensus > 1 {
+		err = p5.exitConsensus(sock, protocol, hmd.resp, answered, consensus, answered)
+	}
 	if err != nil {
 		p5.badProx.Check(sock)
 		return err
 	}
 
-	if newip := net.ParseIP(resp); newip == nil {
-		p5.badProx.Check(sock)
-		return errors.New("bad response from http request: " + resp)
+	p5.exits.record(sock, hmd.resp)
+	p5.recordInterception(sock, hmd.tlsCheck)
+	sock.recordTimings(hmd.timings)
+	return nil
+}
+
+// ipEcho requests checkEndpoint through sock, expecting an IP address back. The returned handMeDown is nil if we
+// could not reach the proxy at all.
+func (p5 *ProxyEngine) ipEcho(sock *Proxy, protocol ProxyProtocol, checkEndpoint string) (*handMeDown, error) {
+	_, endpoint := splitEndpoint(sock.Endpoint)
+
+	// p5.announceValidating(sock, endpoint)
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", endpoint, p5.GetValidationTimeout())
+	if err != nil {
+		return nil, err
 	}
 
-	sock.ProxiedIP = resp
+	hmd := &handMeDown{
+		sock: sock, conn: conn, under: proxy.Direct, protoCheck: protocol, endpoint: checkEndpoint, tlsCheck: newTLSCheck(),
+	}
+	hmd.timings.Connect = time.Since(start)
 
-	return nil
+	if hmd.resp, err = p5.validate(hmd); err != nil {
+		return hmd, err
+	}
+	hmd.resp = strings.TrimSpace(hmd.resp)
+	if newip := net.ParseIP(hmd.resp); newip == nil {
+		return hmd, errors.New("bad response from http request: " + hmd.resp)
+	}
+	return hmd, nil
 }
 
 func (sock *Proxy) validate() {
@@ -227,69 +329,110 @@ func (sock *Proxy) validate() {
 		return
 	}
 
+	pe.check(sock, false)
+}
+
+// revalidate claims sock and validates it in the background with submit, bypassing our ratelimiters.
+// Returns false without validating sock if it is leased or already being validated, or if submit fails.
+func (sock *Proxy) revalidate(submit func(func()) error) bool {
+	if !atomic.CompareAndSwapUint32(&sock.lock, stateUnlocked, stateLocked) {
+		return false
+	}
+	err := submit(func() {
+		defer atomic.StoreUint32(&sock.lock, stateUnlocked)
+		sock.parent.check(sock, true)
+	})
+	if err != nil {
+		atomic.StoreUint32(&sock.lock, stateUnlocked)
+		return false
+	}
+	return true
+}
+
+// check validates sock, which must be locked by the caller, and tallies it if it passes.
+// When forced, proxies that are still sitting in our valid lists are left where they are rather than listed again.
+func (p5 *ProxyEngine) check(sock *Proxy, forced bool) {
+	select {
+	case <-p5.ctx.Done():
+		return
+	default:
+	}
+
 	// TODO: consider giving the option for verbose logging of this stuff?
 
+	var checkErr error
+
 	switch {
-	case sock.timesValidated == 0, sock.protocol.Get() == ProtoNull:
-		// try to use the proxy with all 3 SOCKS versions
+	case sock.protocol.Get() == ProtoNull:
+		// try to use the proxy with all 3 SOCKS versions and HTTP CONNECT
+	probe:
 		for tryProto := range protoMap {
 			if tryProto == ProtoNull {
 				continue
 			}
 			select {
-			case <-pe.ctx.Done():
+			case <-p5.ctx.Done():
 				return
 			default:
-				if err := pe.singleProxyCheck(sock, tryProto); err != nil {
+				if checkErr = p5.singleProxyCheck(sock, tryProto); checkErr != nil {
 					// if the proxy is no good, we continue on to the next.
 					continue
 				}
 				sock.protocol.set(tryProto)
-				break
+				break probe
 			}
 		}
 	default:
-		if err := pe.singleProxyCheck(sock, sock.GetProto()); err != nil {
+		if checkErr = p5.singleProxyCheck(sock, sock.GetProto()); checkErr != nil {
 			sock.bad()
-			pe.badProx.Check(sock)
+			p5.badProx.Check(sock)
+			p5.events.publish(Event{Type: EventValidationFailed, Proxy: sock, Err: checkErr})
 			return
 		}
 	}
 
 	switch sock.protocol.Get() {
 	case ProtoSOCKS4, ProtoSOCKS4a, ProtoSOCKS5, ProtoHTTP:
-		pe.msgChecked(sock, true)
+		p5.msgChecked(sock, true)
 	default:
-		pe.msgChecked(sock, false)
+		p5.msgChecked(sock, false)
 		sock.bad()
-		pe.badProx.Check(sock)
+		p5.badProx.Check(sock)
+		p5.events.publish(Event{Type: EventValidationFailed, Proxy: sock, Err: checkErr})
 		return
 	}
 
 	sock.good()
-	pe.tally(sock)
+	p5.checkProfiles(sock)
+	if !forced || !p5.Valids.forProto(sock.GetProto()).contains(sock) {
+		p5.tally(sock)
+	}
+	p5.emit(EventValidated, sock)
 }
 
 func (p5 *ProxyEngine) tally(sock *Proxy) bool {
-	var target proxyList
 	switch sock.protocol.Get() {
 	case ProtoSOCKS4:
 		p5.stats.v4()
-		target = p5.Valids.SOCKS4
 	case ProtoSOCKS4a:
 		p5.stats.v4a()
-		target = p5.Valids.SOCKS4a
 	case ProtoSOCKS5:
 		p5.stats.v5()
-		target = p5.Valids.SOCKS5
 	case ProtoHTTP:
 		p5.stats.http()
-		target = p5.Valids.HTTP
 	default:
 		return false
 	}
-	target.Lock()
-	target.PushBack(sock)
-	target.Unlock()
+	return p5.enqueue(sock)
+}
+
+// enqueue places sock at the back of the valid list for its protocol and wakes up any getters waiting on one.
+func (p5 *ProxyEngine) enqueue(sock *Proxy) bool {
+	target := p5.Valids.forProto(sock.GetProto())
+	if target == nil {
+		return false
+	}
+	target.add(sock)
+	p5.tallied.broadcast()
 	return true
 }
@@ -0,0 +1,342 @@
+package prox5
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.tcp.direct/kayos/common/entropy"
+)
+
+// ErrValidationFailed is returned when a Validator rejects a proxy without saying why.
+var ErrValidationFailed = errors.New("proxy failed validation")
+
+// DialContextFunc dials addr, see Validator.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Verdict is the outcome of a Validator checking a proxy.
+type Verdict struct {
+	OK bool
+	// ExitIP is the address the proxy's traffic leaves from, if the Validator learned it.
+	ExitIP string
+	// Metadata is anything else the Validator wants to record about the proxy, see Proxy.GetValidationMetadata.
+	Metadata map[string]string
+	// Err explains why the proxy was rejected.
+	Err error
+}
+
+func failed(err error) Verdict {
+	return Verdict{Err: err}
+}
+
+// Validator decides whether a proxy is fit for use, see SetValidators. dial connects through the proxy being validated.
+// Validators should give up once ctx is done.
+type Validator interface {
+	Validate(ctx context.Context, dial DialContextFunc) Verdict
+}
+
+// ValidatorFunc lets an ordinary function act as a Validator.
+type ValidatorFunc func(ctx context.Context, dial DialContextFunc) Verdict
+
+func (f ValidatorFunc) Validate(ctx context.Context, dial DialContextFunc) Verdict {
+	return f(ctx, dial)
+}
+
+// AllOf returns a Validator that accepts a proxy only if every one of validators does, checking them in order.
+// The metadata of every verdict is merged, and the first exit IP reported wins.
+func AllOf(validators ...Validator) Validator {
+	return ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+		merged := Verdict{OK: true, Metadata: make(map[string]string)}
+		for _, v := range validators {
+			verdict := v.Validate(ctx, dial)
+			if !verdict.OK {
+				if verdict.Err == nil {
+					verdict.Err = ErrValidationFailed
+				}
+				return verdict
+			}
+			if merged.ExitIP == "" {
+				merged.ExitIP = verdict.ExitIP
+			}
+			for k, val := range verdict.Metadata {
+				merged.Metadata[k] = val
+			}
+		}
+		return merged
+	})
+}
+
+// AnyOf returns a Validator that accepts a proxy as soon as one of validators does, checking them in order.
+func AnyOf(validators ...Validator) Validator {
+	return ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+		var reasons []string
+		for _, v := range validators {
+			verdict := v.Validate(ctx, dial)
+			if verdict.OK {
+				return verdict
+			}
+			if verdict.Err != nil {
+				reasons = append(reasons, verdict.Err.Error())
+			}
+		}
+		if len(reasons) == 0 {
+			return failed(ErrValidationFailed)
+		}
+		return failed(fmt.Errorf("%w: %s", ErrValidationFailed, strings.Join(reasons, "; ")))
+	})
+}
+
+type (
+	userAgentCtxKey    struct{}
+	validatorTLSCtxKey struct{}
+)
+
+// validatorTLS is what validatorGET needs to check certificates during our own validations.
+type validatorTLS struct {
+	p5 *ProxyEngine
+	*tlsCheck
+}
+
+// validatorContext prepares ctx for running validators against a proxy, certificates they see go to tc.
+func (p5 *ProxyEngine) validatorContext(ctx context.Context, tc *tlsCheck) context.Context {
+	ctx = context.WithValue(ctx, userAgentCtxKey{}, p5.RandomUserAgent())
+	return context.WithValue(ctx, validatorTLSCtxKey{}, &validatorTLS{p5: p5, tlsCheck: tc})
+}
+
+// validatorGET requests endpoint through dial, returning the response status and up to 1MB of its body.
+// During our own validations, the certificate presented for endpoint is checked like that of our check endpoints,
+// see Intercepting.
+func validatorGET(ctx context.Context, dial DialContextFunc, endpoint string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ua, ok := ctx.Value(userAgentCtxKey{}).(string); ok {
+		req.Header.Set("User-Agent", ua)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	if check, ok := ctx.Value(validatorTLSCtxKey{}).(*validatorTLS); ok {
+		tlsConfig = check.p5.validationTLSConfig(endpoint, check.tlsCheck)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       dial,
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig,
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, body, err
+}
+
+// IPEchoValidator requests one of endpoints at random, expecting the proxy's exit IP back as plain text.
+// This is what we do by default, using our check endpoints, see SetCheckEndpoints.
+func IPEchoValidator(endpoints ...string) Validator {
+	return ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+		if len(endpoints) == 0 {
+			return failed(errors.New("no IP echo endpoints to validate against"))
+		}
+		_, body, err := validatorGET(ctx, dial, entropy.RandomStrChoice(endpoints))
+		if err != nil {
+			return failed(err)
+		}
+		ip := strings.TrimSpace(string(body))
+		if net.ParseIP(ip) == nil {
+			return failed(errors.New("bad response from http request: " + ip))
+		}
+		return Verdict{OK: true, ExitIP: ip}
+	})
+}
+
+// JSONFieldValidator requests endpoint and expects a JSON object back with a non-empty value at path, a dot separated
+// list of keys, e.g. "data.ip". The value is recorded in the verdict's metadata under path, and if it is an IP address
+// it is taken as the proxy's exit IP.
+func JSONFieldValidator(endpoint, path string) Validator {
+	keys := strings.Split(path, ".")
+	return ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+		_, body, err := validatorGET(ctx, dial, endpoint)
+		if err != nil {
+			return failed(err)
+		}
+		var value interface{}
+		if err = json.Unmarshal(body, &value); err != nil {
+			return failed(fmt.Errorf("bad JSON from %s: %w", endpoint, err))
+		}
+		for _, key := range keys {
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				return failed(fmt.Errorf("%s is missing from the response", path))
+			}
+			if value, ok = obj[key]; !ok {
+				return failed(fmt.Errorf("%s is missing from the response", path))
+			}
+		}
+		var str string
+		switch v := value.(type) {
+		case string:
+			str = v
+		case nil:
+		default:
+			str = fmt.Sprint(v)
+		}
+		if str == "" {
+			return failed(fmt.Errorf("%s is empty", path))
+		}
+		verdict := Verdict{OK: true, Metadata: map[string]string{path: str}}
+		if net.ParseIP(str) != nil {
+			verdict.ExitIP = str
+		}
+		return verdict
+	})
+}
+
+// HTTPCheckValidator requests endpoint, typically a page on the site the proxies are meant for, and expects status
+// back along with a body matching pattern. A nil pattern accepts any body.
+func HTTPCheckValidator(endpoint string, status int, pattern *regexp.Regexp) Validator {
+	return ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+		got, body, err := validatorGET(ctx, dial, endpoint)
+		if err != nil {
+			return failed(err)
+		}
+		if got != status {
+			return failed(fmt.Errorf("%s answered with status %d, wanted %d", endpoint, got, status))
+		}
+		if pattern != nil && !pattern.Match(body) {
+			return failed(fmt.Errorf("response from %s does not match %s", endpoint, pattern))
+		}
+		return Verdict{OK: true, Metadata: map[string]string{"status": strconv.Itoa(got)}}
+	})
+}
+
+// BannerValidator connects to addr over raw TCP and expects the banner the server greets us with to match pattern,
+// e.g. BannerValidator("smtp.example.com:25", regexp.MustCompile(`^220 `)). The banner is recorded in the verdict's metadata.
+func BannerValidator(addr string, pattern *regexp.Regexp) Validator {
+	return ValidatorFunc(func(ctx context.Context, dial DialContextFunc) Verdict {
+		conn, err := dial(ctx, "tcp", addr)
+		if err != nil {
+			return failed(err)
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetReadDeadline(deadline)
+		}
+		buf := make([]byte, 1024)
+		var banner []byte
+		for !pattern.Match(banner) && len(banner) < cap(buf)*4 {
+			n, rerr := conn.Read(buf)
+			banner = append(banner, buf[:n]...)
+			if rerr != nil {
+				break
+			}
+		}
+		if !pattern.Match(banner) {
+			return failed(fmt.Errorf("banner from %s does not match %s: %q", addr, pattern, banner))
+		}
+		return Verdict{OK: true, Metadata: map[string]string{"banner": strings.TrimSpace(string(banner))}}
+	})
+}
+
+// candidateDialer returns a DialContextFunc that tunnels through sock as protocol, recording the timings of its
+// first dial in timings.
+func (p5 *ProxyEngine) candidateDialer(sock *Proxy, protocol ProxyProtocol, timings *Timings) DialContextFunc {
+	first := &sync.Once{}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, endpoint := splitEndpoint(sock.Endpoint)
+		start := time.Now()
+		conn, err := (&net.Dialer{Timeout: p5.GetValidationTimeout()}).DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		connected := time.Now()
+		tunnel, err := p5.validationHandshaker(sock, protocol, conn)(network, addr)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		first.Do(func() {
+			timings.Connect = connected.Sub(start)
+			timings.Handshake = time.Since(connected)
+		})
+		return tunnel, nil
+	}
+}
+
+// validatorCheck checks sock with each of validators in turn, they must all accept it. See SetValidators.
+func (p5 *ProxyEngine) validatorCheck(sock *Proxy, protocol ProxyProtocol, validators []Validator) error {
+	var timings Timings
+	dial := p5.candidateDialer(sock, protocol, &timings)
+	merged := Verdict{OK: true, Metadata: make(map[string]string)}
+	tc := newTLSCheck()
+	for _, v := range validators {
+		ctx, cancel := context.WithTimeout(p5.ctx, p5.GetValidationTimeout())
+		verdict := v.Validate(p5.validatorContext(ctx, tc), dial)
+		cancel()
+		if !verdict.OK {
+			p5.badProx.Check(sock)
+			if verdict.Err == nil {
+				return ErrValidationFailed
+			}
+			return verdict.Err
+		}
+		if merged.ExitIP == "" {
+			merged.ExitIP = verdict.ExitIP
+		}
+		for k, val := range verdict.Metadata {
+			merged.Metadata[k] = val
+		}
+	}
+	if consensus := p5.GetExitConsensus(); consensus > 1 {
+		if sock.IsUntrusted() {
+			return ErrUntrusted
+		}
+		if merged.ExitIP != "" {
+			if err := p5.exitConsensus(sock, protocol, merged.ExitIP, "our validators", consensus); err != nil {
+				p5.badProx.Check(sock)
+				return err
+			}
+		}
+	}
+	if merged.ExitIP != "" {
+		p5.exits.record(sock, merged.ExitIP)
+	}
+	p5.recordInterception(sock, tc)
+	sock.validation.Store(&merged.Metadata)
+	if timings.Connect > 0 {
+		sock.recordTimings(timings)
+	}
+	return nil
+}
+
+// GetValidationMetadata returns what our validators recorded about the proxy the last time they accepted it,
+// see SetValidators.
+func (sock *Proxy) GetValidationMetadata() map[string]string {
+	meta := sock.validation.Load()
+	if meta == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(*meta))
+	for k, v := range *meta {
+		copied[k] = v
+	}
+	return copied
+}
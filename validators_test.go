@@ -0,0 +1,160 @@
+package prox5
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newValidatorSite(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.7\n"))
+	})
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data": {"ip": "203.0.113.8", "asn": 64496}}`))
+	})
+	mux.HandleFunc("/shop", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.UserAgent(), "Go-http-client") {
+			http.Error(w, "bots not welcome", http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("<title>Totally Real Shop</title>"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newBannerServer(t *testing.T, banner string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte(banner))
+			_ = conn.Close()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	return ln.Addr().String()
+}
+
+func TestValidators(t *testing.T) {
+	site := newValidatorSite(t)
+	smtp := newBannerServer(t, "220 mail.example.com ESMTP\r\n")
+	direct := DialContextFunc((&net.Dialer{}).DialContext)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	uaCtx := context.WithValue(ctx, userAgentCtxKey{}, "Mozilla/5.0")
+
+	tests := []struct {
+		name   string
+		v      Validator
+		ctx    context.Context
+		ok     bool
+		exitIP string
+		meta   map[string]string
+	}{
+		{name: "ip echo", v: IPEchoValidator(site.URL + "/ip"), ok: true, exitIP: "203.0.113.7"},
+		{name: "ip echo bad body", v: IPEchoValidator(site.URL + "/json")},
+		{
+			name: "json field", v: JSONFieldValidator(site.URL+"/json", "data.ip"), ok: true,
+			exitIP: "203.0.113.8", meta: map[string]string{"data.ip": "203.0.113.8"},
+		},
+		{name: "json number", v: JSONFieldValidator(site.URL+"/json", "data.asn"), ok: true, meta: map[string]string{"data.asn": "64496"}},
+		{name: "json missing", v: JSONFieldValidator(site.URL+"/json", "data.country")},
+		{name: "http check", v: HTTPCheckValidator(site.URL+"/shop", 200, regexp.MustCompile("Real Shop")), ctx: uaCtx, ok: true},
+		{name: "http check blocked", v: HTTPCheckValidator(site.URL+"/shop", 200, nil)},
+		{name: "http check body", v: HTTPCheckValidator(site.URL+"/shop", 200, regexp.MustCompile("Fake")), ctx: uaCtx},
+		{
+			name: "banner", v: BannerValidator(smtp, regexp.MustCompile(`^220 `)), ok: true,
+			meta: map[string]string{"banner": "220 mail.example.com ESMTP"},
+		},
+		{name: "banner mismatch", v: BannerValidator(smtp, regexp.MustCompile(`^SSH-`))},
+		{
+			name: "all of", v: AllOf(IPEchoValidator(site.URL+"/ip"), JSONFieldValidator(site.URL+"/json", "data.ip")),
+			ok: true, exitIP: "203.0.113.7", meta: map[string]string{"data.ip": "203.0.113.8"},
+		},
+		{name: "all of failing", v: AllOf(IPEchoValidator(site.URL+"/ip"), JSONFieldValidator(site.URL+"/json", "nope"))},
+		{
+			name: "any of", v: AnyOf(IPEchoValidator(site.URL+"/json"), JSONFieldValidator(site.URL+"/json", "data.ip")),
+			ok: true, exitIP: "203.0.113.8", meta: map[string]string{"data.ip": "203.0.113.8"},
+		},
+		{name: "any of failing", v: AnyOf(IPEchoValidator(site.URL+"/json"), JSONFieldValidator(site.URL+"/json", "nope"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vctx := tt.ctx
+			if vctx == nil {
+				vctx = ctx
+			}
+			verdict := tt.v.Validate(vctx, direct)
+			if verdict.OK != tt.ok {
+				t.Fatalf("expected OK to be %t, got %t (%v)", tt.ok, verdict.OK, verdict.Err)
+			}
+			if !tt.ok {
+				if verdict.Err == nil {
+					t.Error("expected rejections to come with an error")
+				}
+				return
+			}
+			if verdict.ExitIP != tt.exitIP {
+				t.Errorf("expected exit IP %q, got %q", tt.exitIP, verdict.ExitIP)
+			}
+			for k, want := range tt.meta {
+				if got := verdict.Metadata[k]; got != want {
+					t.Errorf("expected metadata %s to be %q, got %q", k, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSetValidators(t *testing.T) {
+	site := newValidatorSite(t)
+	upstream := newDummyHTTPProxy(t, "", "")
+
+	p5 := NewProxyEngine()
+	defer func() {
+		_ = p5.Close()
+	}()
+	p5.SetValidationTimeout(2 * time.Second)
+	p5.SetValidators(
+		JSONFieldValidator(site.URL+"/json", "data.ip"),
+		HTTPCheckValidator(site.URL+"/shop", 200, regexp.MustCompile("Real Shop")),
+	)
+
+	sock, _ := p5.proxyMap.add(upstream.Addr().String())
+	if err := p5.singleProxyCheck(sock, ProtoHTTP); err != nil {
+		t.Fatal(err)
+	}
+	if sock.GetExitIP() != "203.0.113.8" {
+		t.Errorf("expected our validators to record the exit IP, got %q", sock.GetExitIP())
+	}
+	if meta := sock.GetValidationMetadata(); meta["data.ip"] != "203.0.113.8" || meta["status"] != "200" {
+		t.Errorf("unexpected validation metadata: %v", meta)
+	}
+	if upstream.tunnels.Load() != 2 {
+		t.Errorf("expected both validators to go through the proxy, got %d tunnels", upstream.tunnels.Load())
+	}
+
+	p5.SetValidators(HTTPCheckValidator(site.URL+"/shop", 200, regexp.MustCompile("Fake")))
+	if err := p5.singleProxyCheck(sock, ProtoHTTP); err == nil {
+		t.Fatal("expected a failing validator to fail the check")
+	}
+}